@@ -1,17 +1,29 @@
 module github.com/chensk/go-swiss-knife
 
-go 1.18
+go 1.20
 
 require (
+	github.com/alicebob/miniredis/v2 v2.31.1
 	github.com/go-redis/redis/v8 v8.11.0
-	gorm.io/driver/mysql v1.1.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	google.golang.org/grpc v1.59.0
+	gorm.io/driver/sqlite v1.1.4
 	gorm.io/gorm v1.21.10
 )
 
 require (
-	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/go-sql-driver/mysql v1.6.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.2 // indirect
+	github.com/mattn/go-sqlite3 v1.14.5 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
+	golang.org/x/net v0.14.0 // indirect
+	golang.org/x/sys v0.11.0 // indirect
+	golang.org/x/text v0.12.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230822172742-b8732ec3820d // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
 )
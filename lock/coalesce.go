@@ -0,0 +1,130 @@
+package lock
+
+import (
+	"sync"
+	"time"
+)
+
+// NewCoalescingProvider wraps provider so that goroutines of the current process contending for the same lock name
+// are serialized on a local mutex first, and only the one holding it talks to the backend. Semantics across processes
+// are unchanged, while the load on the backend no longer grows with the number of local waiters. The locks of
+// different providers are not serialized with each other even if they share a name, which requires provider to be
+// comparable, e.g. a pointer.
+func NewCoalescingProvider(provider LockProvider) LockProvider {
+	if c, ok := provider.(coalescingProvider); ok {
+		return c
+	}
+	return coalescingProvider{provider: provider}
+}
+
+type coalescingProvider struct {
+	provider LockProvider
+}
+
+type coalescedLock struct {
+	Lock
+	key   localMutexKey
+	local *localMutex
+	once  sync.Once
+}
+
+func (c *coalescedLock) Unlock() error {
+	err := c.Lock.Unlock()
+	c.once.Do(func() {
+		c.local.unlock(c.key)
+	})
+	return err
+}
+
+func (c coalescingProvider) Lock(conf Configuration) (Lock, error) {
+	key := localMutexKey{provider: c.provider, name: conf.Name}
+	m := retainLocalMutex(key)
+	start := time.Now()
+	ctx, cancel := conf.WaitContext()
+	defer cancel()
+	select {
+	case m.ch <- struct{}{}:
+	case <-ctx.Done():
+		m.release(key)
+		return nil, WaitErr(ctx)
+	}
+	if conf.LockTimeout > 0 {
+		// the time spent waiting locally counts towards the timeout
+		conf.LockTimeout -= time.Since(start)
+		if conf.LockTimeout <= 0 {
+			m.unlock(key)
+			return nil, ErrTimeout
+		}
+	}
+	l, err := c.provider.Lock(conf)
+	if err != nil {
+		m.unlock(key)
+		return nil, err
+	}
+	return &coalescedLock{Lock: l, key: key, local: m}, nil
+}
+
+func (c coalescingProvider) TryLock(conf Configuration) (Lock, error) {
+	key := localMutexKey{provider: c.provider, name: conf.Name}
+	m := retainLocalMutex(key)
+	select {
+	case m.ch <- struct{}{}:
+	default:
+		// held by another goroutine of this process, no need to ask the backend
+		m.release(key)
+		return nil, ErrLockFailed
+	}
+	l, err := c.provider.TryLock(conf)
+	if err != nil {
+		m.unlock(key)
+		return nil, err
+	}
+	return &coalescedLock{Lock: l, key: key, local: m}, nil
+}
+
+// localMutex is a channel based mutex so that waiting can be abandoned on timeout. refs counts the goroutines holding
+// or waiting for it, and the mutex is dropped from localMutexes once nobody references it any more.
+type localMutex struct {
+	ch   chan struct{}
+	refs int
+}
+
+// localMutexKey identifies the lock of a provider, since the same name may refer to unrelated locks of different
+// providers, e.g. two databases.
+type localMutexKey struct {
+	provider LockProvider
+	name     string
+}
+
+var (
+	localMutexesMu sync.Mutex
+	localMutexes   = make(map[localMutexKey]*localMutex)
+)
+
+func retainLocalMutex(key localMutexKey) *localMutex {
+	localMutexesMu.Lock()
+	defer localMutexesMu.Unlock()
+	m, ok := localMutexes[key]
+	if !ok {
+		m = &localMutex{ch: make(chan struct{}, 1)}
+		localMutexes[key] = m
+	}
+	m.refs++
+	return m
+}
+
+// release drops the reference taken by retainLocalMutex without touching the mutex itself.
+func (m *localMutex) release(key localMutexKey) {
+	localMutexesMu.Lock()
+	defer localMutexesMu.Unlock()
+	m.refs--
+	if m.refs == 0 {
+		delete(localMutexes, key)
+	}
+}
+
+// unlock releases the mutex and the reference held by the owner.
+func (m *localMutex) unlock(key localMutexKey) {
+	<-m.ch
+	m.release(key)
+}
@@ -0,0 +1,165 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// CounterProvider is implemented by lock providers able to keep named counters shared by all the nodes, which back
+// CountDownLatch and Barrier.
+type CounterProvider interface {
+	// InitCounter creates the counter called name with value if it doesn't exist yet.
+	InitCounter(name string, value int64) error
+	// AddCounter atomically adds delta to the counter called name and returns the new value. If the counter doesn't
+	// exist, it's created with 0 first.
+	AddCounter(name string, delta int64) (int64, error)
+	// GetCounter returns the value of the counter called name, 0 if it doesn't exist.
+	GetCounter(name string) (int64, error)
+	// DeleteCounter deletes the counter called name, doing nothing if it doesn't exist.
+	DeleteCounter(name string) error
+}
+
+// CountDownLatch allows the nodes to wait until count events have happened on any node.
+type CountDownLatch struct {
+	name     string
+	counters CounterProvider
+	conf     Configuration
+}
+
+// NewCountDownLatch creates the latch called name which is open once CountDown has been called count times. Nodes
+// sharing the latch should create it with the same count, only the first one initializes it, hence a name can't be
+// reused until the latch is deleted by Delete. provider must implement CounterProvider. Options such as WithLockTimeout
+// bound the waiting of Await.
+func NewCountDownLatch(name string, count int, provider LockProvider, options ...Options) (*CountDownLatch, error) {
+	counters, conf, err := newCounterConf(name, provider, options)
+	if err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		return nil, errors.New("latch count must be positive")
+	}
+	if err := counters.InitCounter(name, int64(count)); err != nil {
+		return nil, err
+	}
+	return &CountDownLatch{name: name, counters: counters, conf: conf}, nil
+}
+
+// CountDown decrements the count of the latch, releasing the waiters once it reaches zero.
+func (l *CountDownLatch) CountDown() error {
+	_, err := l.counters.AddCounter(l.name, -1)
+	return err
+}
+
+// Count returns the current count of the latch.
+func (l *CountDownLatch) Count() (int64, error) {
+	c, err := l.counters.GetCounter(l.name)
+	if c < 0 {
+		c = 0
+	}
+	return c, err
+}
+
+// Await blocks until the count reaches zero. It returns ErrTimeout if the timeout specified by WithLockTimeout
+// elapses first, or ctx.Err() if ctx is done first.
+func (l *CountDownLatch) Await(ctx context.Context) error {
+	return awaitCounter(ctx, l.conf, func() (bool, error) {
+		c, err := l.counters.GetCounter(l.name)
+		return c <= 0, err
+	})
+}
+
+// Delete deletes the latch from the provider, so that its name can be used by a new latch, e.g. the next run of a daily
+// job. It should be called by one node once all the nodes are done with the latch, since the nodes still using it see
+// it as a fresh one with the count of 0, i.e. open.
+func (l *CountDownLatch) Delete() error {
+	return l.counters.DeleteCounter(l.name)
+}
+
+// Barrier allows a fixed number of parties to wait for each other. It's cyclic: once all the parties have arrived,
+// the next Await calls wait for a new round.
+type Barrier struct {
+	name     string
+	parties  int64
+	counters CounterProvider
+	conf     Configuration
+}
+
+// NewBarrier creates the barrier called name tripped once parties nodes have called Await. The arrivals are kept by the
+// provider until the barrier is deleted by Delete. provider must implement CounterProvider. Options such as WithLockTimeout bound the waiting of Await.
+func NewBarrier(name string, parties int, provider LockProvider, options ...Options) (*Barrier, error) {
+	counters, conf, err := newCounterConf(name, provider, options)
+	if err != nil {
+		return nil, err
+	}
+	if parties <= 0 {
+		return nil, errors.New("barrier parties must be positive")
+	}
+	return &Barrier{name: name, parties: int64(parties), counters: counters, conf: conf}, nil
+}
+
+// Await registers the arrival of the caller and blocks until all the parties of the current round have arrived.
+// It returns ErrTimeout if the timeout specified by WithLockTimeout elapses first, or ctx.Err() if ctx is done first.
+// The arrival is counted even if the caller gives up waiting.
+func (b *Barrier) Await(ctx context.Context) error {
+	arrived, err := b.counters.AddCounter(b.name, 1)
+	if err != nil {
+		return err
+	}
+	// the counter only grows, so the round is derived from the number of arrivals
+	target := ((arrived-1)/b.parties + 1) * b.parties
+	return awaitCounter(ctx, b.conf, func() (bool, error) {
+		c, err := b.counters.GetCounter(b.name)
+		return c >= target, err
+	})
+}
+
+// Delete deletes the barrier from the provider, so that its name can be reused from the first round. It should be
+// called by one node once all the nodes are done with the barrier.
+func (b *Barrier) Delete() error {
+	return b.counters.DeleteCounter(b.name)
+}
+
+func newCounterConf(name string, provider LockProvider, options []Options) (CounterProvider, Configuration, error) {
+	conf := Configuration{Name: name, Provider: provider}
+	for _, opt := range options {
+		opt.Apply(&conf)
+	}
+	if conf.Provider == nil {
+		return nil, conf, ErrProviderNotFound
+	}
+	if name == "" {
+		return nil, conf, errors.New("name empty")
+	}
+	counters, ok := conf.Provider.(CounterProvider)
+	if !ok {
+		return nil, conf, ErrCounterNotSupported
+	}
+	return counters, conf, nil
+}
+
+// awaitCounter polls done until it returns true or the waiting is over.
+func awaitCounter(ctx context.Context, conf Configuration, done func() (bool, error)) error {
+	conf.Context = ctx
+	waitCtx, cancel := conf.WaitContext()
+	defer cancel()
+	for {
+		ok, err := done()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-time.After(awaitPollInterval):
+		case <-waitCtx.Done():
+			return WaitErr(waitCtx)
+		}
+	}
+}
+
+// awaitPollInterval is the interval latch and barrier waiters check the counter
+var awaitPollInterval = 100 * time.Millisecond
+
+var ErrCounterNotSupported = errors.New("provider doesn't support counters")
@@ -0,0 +1,105 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// LedgerProvider is implemented by lock providers able to remember the jobs which have run, which backs RunOnce.
+type LedgerProvider interface {
+	// GetJob returns the record of the job called key, or ErrJobNotFound if it has never run.
+	GetJob(key string) (JobRecord, error)
+	// SaveJob creates the record of the job, or overwrites it if it exists.
+	SaveJob(record JobRecord) error
+}
+
+type JobStatus string
+
+const (
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+)
+
+// JobRecord is the outcome of the last run of a job.
+type JobRecord struct {
+	Key    string
+	Status JobStatus
+	// Result is the summary returned by the task, or the error message if the task failed.
+	Result string
+	// CompletedBy records the host ip which ran the job.
+	CompletedBy string
+	CompletedAt time.Time
+}
+
+// RunOnce runs task under the lock called key and records its outcome in the ledger of the provider, which must
+// implement LedgerProvider. Once the job has completed, later calls on any node don't run task again but return the
+// stored record and false, unless WithForceRun is specified. Failed jobs are run again by the next call.
+// The task is run the same way as WithLock, and WithContext specifies the context passed to it.
+func RunOnce(key string, task func(ctx context.Context) (string, error), options ...Options) (JobRecord, bool, error) {
+	conf := Configuration{Name: key}
+	runOpt := runOnceOptions{}
+	for _, opt := range options {
+		opt.Apply(&conf)
+		if o, ok := opt.(*runOnceOption); ok {
+			o.f(&runOpt)
+		}
+	}
+	if conf.Provider == nil {
+		return JobRecord{}, false, ErrProviderNotFound
+	}
+	ledger, ok := conf.Provider.(LedgerProvider)
+	if !ok {
+		return JobRecord{}, false, ErrLedgerNotSupported
+	}
+	ctx := conf.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var ran bool
+	record, err := Do(ctx, key, func(ctx context.Context) (JobRecord, error) {
+		record, err := ledger.GetJob(key)
+		if err != nil && !errors.Is(err, ErrJobNotFound) {
+			return record, err
+		}
+		if err == nil && record.Status == JobCompleted && !runOpt.ForceRun {
+			return record, nil
+		}
+		ran = true
+		result, taskErr := task(ctx)
+		record = JobRecord{Key: key, Status: JobCompleted, Result: result, CompletedBy: CurrentIp, CompletedAt: time.Now()}
+		if taskErr != nil {
+			record.Status = JobFailed
+			record.Result = taskErr.Error()
+		}
+		if err := ledger.SaveJob(record); err != nil {
+			return record, errors.Join(taskErr, err)
+		}
+		return record, taskErr
+	}, options...)
+	return record, ran, err
+}
+
+// WithForceRun makes RunOnce run the task even if the job has completed before.
+func WithForceRun() Options {
+	return &runOnceOption{f: func(opt *runOnceOptions) {
+		opt.ForceRun = true
+	}}
+}
+
+// runOnceOptions are the options only used by RunOnce, which are kept out of the Configuration passed to providers.
+type runOnceOptions struct {
+	ForceRun bool
+}
+
+// runOnceOption is the Options applied to runOnceOptions by RunOnce, which doesn't change the Configuration.
+type runOnceOption struct {
+	f func(opt *runOnceOptions)
+}
+
+func (o *runOnceOption) Apply(*Configuration) {}
+
+var (
+	ErrLedgerNotSupported = errors.New("provider doesn't support job ledger")
+	ErrJobNotFound        = errors.New("job not found")
+)
@@ -1,6 +1,7 @@
 package lock
 
 import (
+	"context"
 	"errors"
 	"github.com/chensk/go-swiss-knife/net"
 	"time"
@@ -25,7 +26,11 @@ func LockTask(name string, options ...Options) (Lock, error) {
 	}
 	var lock Lock
 	conf.LockBy = CurrentIp
-	if l, err := conf.Provider.Lock(conf); err == nil {
+	provider := conf.Provider
+	if conf.LocalCoalescing {
+		provider = NewCoalescingProvider(provider)
+	}
+	if l, err := provider.Lock(conf); err == nil {
 		lock = l
 	} else {
 		return nil, err
@@ -45,7 +50,11 @@ func TryLockTask(name string, options ...Options) (Lock, error) {
 	}
 	var lock Lock
 	conf.LockBy = CurrentIp
-	if l, err := conf.Provider.TryLock(conf); err == nil {
+	provider := conf.Provider
+	if conf.LocalCoalescing {
+		provider = NewCoalescingProvider(provider)
+	}
+	if l, err := provider.TryLock(conf); err == nil {
 		lock = l
 	} else {
 		return nil, err
@@ -75,6 +84,31 @@ func WithLockTimeout(timeout time.Duration) Options {
 	})
 }
 
+// WithContext specifies the context bounding the waiting of LockTask. If ctx is done before the lock is acquired,
+// LockTask stops waiting and returns ctx.Err(). It works together with WithLockTimeout, whichever comes first.
+func WithContext(ctx context.Context) Options {
+	return newFuncOptions(func(opt *Configuration) {
+		opt.Context = ctx
+	})
+}
+
+// WithFairness makes blocking waiters register a ticket in the provider and get the lock strictly in arrival order,
+// so that no waiter starves. Tickets are abandoned when waiting times out or is cancelled. TryLockTask with fairness
+// fails while other waiters are queued. Mixing fair and unfair callers on the same lock gives no ordering guarantee.
+func WithFairness() Options {
+	return newFuncOptions(func(opt *Configuration) {
+		opt.Fair = true
+	})
+}
+
+// WithLocalCoalescing serializes the goroutines of the current process contending for the same lock name on a local
+// mutex, so that only one of them talks to the provider at a time. See NewCoalescingProvider.
+func WithLocalCoalescing() Options {
+	return newFuncOptions(func(opt *Configuration) {
+		opt.LocalCoalescing = true
+	})
+}
+
 func WithProvider(provider LockProvider) Options {
 	return newFuncOptions(func(opt *Configuration) {
 		opt.Provider = provider
@@ -87,6 +121,32 @@ type Configuration struct {
 	LockAtMost  time.Duration
 	LockTimeout time.Duration
 	LockBy      string
+	Context     context.Context
+
+	LocalCoalescing bool
+	Fair            bool
+}
+
+// WaitContext returns the context bounding the time spent waiting for the lock, which is derived from Context and
+// LockTimeout. Providers should stop waiting once it's done and return WaitErr.
+func (c Configuration) WaitContext() (context.Context, context.CancelFunc) {
+	ctx := c.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.LockTimeout > 0 {
+		return context.WithTimeout(ctx, c.LockTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// WaitErr converts the error of a done WaitContext to the error returned to users: ErrTimeout if the wait timed out,
+// or the cancellation cause otherwise.
+func WaitErr(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ctx.Err()
 }
 
 type LockProvider interface {
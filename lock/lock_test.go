@@ -0,0 +1,130 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingProvider grants every lock immediately and records how many callers are inside the provider at once.
+type countingProvider struct {
+	inside  int32
+	maxSeen int32
+	calls   int32
+}
+
+type countingLock struct {
+	p *countingProvider
+}
+
+func (c countingLock) Unlock() error {
+	atomic.AddInt32(&c.p.inside, -1)
+	return nil
+}
+
+func (c *countingProvider) Lock(Configuration) (Lock, error) {
+	atomic.AddInt32(&c.calls, 1)
+	n := atomic.AddInt32(&c.inside, 1)
+	for {
+		m := atomic.LoadInt32(&c.maxSeen)
+		if n <= m || atomic.CompareAndSwapInt32(&c.maxSeen, m, n) {
+			break
+		}
+	}
+	return countingLock{p: c}, nil
+}
+
+func (c *countingProvider) TryLock(conf Configuration) (Lock, error) {
+	return c.Lock(conf)
+}
+
+func TestLocalCoalescing(t *testing.T) {
+	p := &countingProvider{}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := LockTask("coalesce", WithProvider(p), WithLocalCoalescing())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			time.Sleep(time.Millisecond)
+			_ = l.Unlock()
+		}()
+	}
+	wg.Wait()
+	if p.maxSeen != 1 || p.calls != 50 {
+		t.Fatalf("expected serialized calls, max concurrent: %d, calls: %d", p.maxSeen, p.calls)
+	}
+	if len(localMutexes) != 0 {
+		t.Fatalf("local mutexes leaked: %d", len(localMutexes))
+	}
+
+	l, err := TryLockTask("coalesce", WithProvider(p), WithLocalCoalescing())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryLockTask("coalesce", WithProvider(p), WithLocalCoalescing()); err != ErrLockFailed {
+		t.Fatalf("expected ErrLockFailed, got %v", err)
+	}
+	if _, err := LockTask("coalesce", WithProvider(p), WithLocalCoalescing(), WithLockTimeout(10*time.Millisecond)); err != ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	// the lock of the same name of another provider is unrelated
+	other, err := TryLockTask("coalesce", WithProvider(&countingProvider{}), WithLocalCoalescing())
+	if err != nil {
+		t.Fatalf("expected the lock of another provider granted, got %v", err)
+	}
+	_ = other.Unlock()
+	_ = l.Unlock()
+}
+
+func TestWithLock(t *testing.T) {
+	p := &countingProvider{}
+	taskErr := errors.New("task failed")
+	err := WithLock(context.Background(), "with-lock", func(ctx context.Context) error {
+		return taskErr
+	}, WithProvider(p))
+	if !errors.Is(err, taskErr) || p.inside != 0 {
+		t.Fatalf("unexpected result: %v, held: %d", err, p.inside)
+	}
+
+	v, err := Do(context.Background(), "with-lock", func(ctx context.Context) (int, error) {
+		<-ctx.Done()
+		return 42, ctx.Err()
+	}, WithProvider(p), WithLockAtMost(10*time.Millisecond))
+	if v != 42 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected result: %d, %v", v, err)
+	}
+
+	// the spare capacity of the options passed is not written to
+	shared := make([]Options, 1, 2)
+	shared[0] = WithProvider(p)
+	if _, err := Do(context.Background(), "with-lock", func(ctx context.Context) (int, error) {
+		return 0, nil
+	}, shared...); err != nil {
+		t.Fatal(err)
+	}
+	if shared[:2][1] != nil {
+		t.Fatal("options of the caller modified")
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("panic not propagated: %v", r)
+			}
+		}()
+		_ = WithLock(context.Background(), "with-lock", func(ctx context.Context) error {
+			panic("boom")
+		}, WithProvider(p))
+	}()
+	if p.inside != 0 {
+		t.Fatal("lock not released after panic")
+	}
+}
@@ -0,0 +1,218 @@
+package provider
+
+import (
+	"container/list"
+	"github.com/chensk/go-swiss-knife/lock"
+	"sync"
+	"time"
+)
+
+// NewMemoryLockProvider creates a lock provider keeping the locks in local memory, which is useful for single node
+// deployment and tests. Unlike mysql provider, LockAtMost is optional: if not positive, the lock is held until it's
+// released explicitly.
+func NewMemoryLockProvider() lock.LockProvider {
+	return &memoryLockProvider{
+		locks:    make(map[string]*memoryLockState),
+		counters: make(map[string]int64),
+		jobs:     make(map[string]lock.JobRecord),
+	}
+}
+
+type memoryLockProvider struct {
+	mutex sync.Mutex
+	locks map[string]*memoryLockState
+	// token identifies each acquisition so that an expired holder can't release the lock of the next one
+	token    uint64
+	counters map[string]int64
+	jobs     map[string]lock.JobRecord
+}
+
+type memoryLockState struct {
+	token    uint64
+	until    time.Time
+	lockedBy string
+	// released is closed whenever the lock may have become available to waiters
+	released chan struct{}
+	// waiters holds the tickets of fair waiters in arrival order
+	waiters *list.List
+	// refs counts the goroutines referencing the state while waiting
+	refs int
+}
+
+type memoryLock struct {
+	name     string
+	token    uint64
+	provider *memoryLockProvider
+}
+
+func (m memoryLock) Unlock() error {
+	m.provider.mutex.Lock()
+	defer m.provider.mutex.Unlock()
+	st, ok := m.provider.locks[m.name]
+	if !ok || st.token != m.token {
+		// expired and maybe taken by others
+		return nil
+	}
+	st.token = 0
+	st.notify()
+	m.provider.removeIfIdle(m.name, st)
+	return nil
+}
+
+func (m *memoryLockProvider) Lock(conf lock.Configuration) (lock.Lock, error) {
+	if conf.Name == "" {
+		return nil, ErrEmptyName
+	}
+	ctx, cancel := conf.WaitContext()
+	defer cancel()
+
+	m.mutex.Lock()
+	st := m.state(conf.Name)
+	st.refs++
+	var ticket *list.Element
+	if conf.Fair {
+		ticket = st.waiters.PushBack(struct{}{})
+	}
+	for {
+		now := time.Now()
+		if st.available(now) && (ticket == nil || st.waiters.Front() == ticket) {
+			if ticket != nil {
+				st.waiters.Remove(ticket)
+			}
+			st.refs--
+			l := m.acquire(conf, st, now)
+			m.mutex.Unlock()
+			return l, nil
+		}
+		wake := st.released
+		var expire <-chan time.Time
+		var timer *time.Timer
+		if st.token != 0 && !st.until.IsZero() {
+			timer = time.NewTimer(st.until.Sub(now))
+			expire = timer.C
+		}
+		m.mutex.Unlock()
+
+		var done bool
+		select {
+		case <-wake:
+		case <-expire:
+		case <-ctx.Done():
+			done = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		m.mutex.Lock()
+		if done {
+			if ticket != nil {
+				// abandon the ticket, the next waiter may be able to go on
+				st.waiters.Remove(ticket)
+				st.notify()
+			}
+			st.refs--
+			m.removeIfIdle(conf.Name, st)
+			m.mutex.Unlock()
+			return nil, lock.WaitErr(ctx)
+		}
+	}
+}
+
+func (m *memoryLockProvider) TryLock(conf lock.Configuration) (lock.Lock, error) {
+	if conf.Name == "" {
+		return nil, ErrEmptyName
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	st := m.state(conf.Name)
+	now := time.Now()
+	if !st.available(now) || (conf.Fair && st.waiters.Len() > 0) {
+		m.removeIfIdle(conf.Name, st)
+		return nil, lock.ErrLockFailed
+	}
+	return m.acquire(conf, st, now), nil
+}
+
+func (m *memoryLockProvider) InitCounter(name string, value int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.counters[name]; !ok {
+		m.counters[name] = value
+	}
+	return nil
+}
+
+func (m *memoryLockProvider) AddCounter(name string, delta int64) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.counters[name] += delta
+	return m.counters[name], nil
+}
+
+func (m *memoryLockProvider) DeleteCounter(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.counters, name)
+	return nil
+}
+
+func (m *memoryLockProvider) GetCounter(name string) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.counters[name], nil
+}
+
+func (m *memoryLockProvider) GetJob(key string) (lock.JobRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	record, ok := m.jobs[key]
+	if !ok {
+		return lock.JobRecord{}, lock.ErrJobNotFound
+	}
+	return record, nil
+}
+
+func (m *memoryLockProvider) SaveJob(record lock.JobRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.jobs[record.Key] = record
+	return nil
+}
+
+// state returns the state of the lock called name, creating it if absent. mutex must be held.
+func (m *memoryLockProvider) state(name string) *memoryLockState {
+	st, ok := m.locks[name]
+	if !ok {
+		st = &memoryLockState{released: make(chan struct{}), waiters: list.New()}
+		m.locks[name] = st
+	}
+	return st
+}
+
+// acquire marks the lock as held by conf.LockBy. mutex must be held.
+func (m *memoryLockProvider) acquire(conf lock.Configuration, st *memoryLockState, now time.Time) lock.Lock {
+	m.token++
+	st.token = m.token
+	st.lockedBy = conf.LockBy
+	st.until = time.Time{}
+	if conf.LockAtMost > 0 {
+		st.until = now.Add(conf.LockAtMost)
+	}
+	return memoryLock{name: conf.Name, token: st.token, provider: m}
+}
+
+// removeIfIdle drops the state if nobody holds or waits for the lock. mutex must be held.
+func (m *memoryLockProvider) removeIfIdle(name string, st *memoryLockState) {
+	if st.available(time.Now()) && st.refs == 0 && st.waiters.Len() == 0 {
+		delete(m.locks, name)
+	}
+}
+
+func (st *memoryLockState) available(now time.Time) bool {
+	return st.token == 0 || (!st.until.IsZero() && !st.until.After(now))
+}
+
+func (st *memoryLockState) notify() {
+	close(st.released)
+	st.released = make(chan struct{})
+}
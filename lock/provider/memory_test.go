@@ -0,0 +1,167 @@
+package provider
+
+import (
+	"context"
+	"github.com/chensk/go-swiss-knife/lock"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryLockFairness(t *testing.T) {
+	p := NewMemoryLockProvider()
+	holder, err := lock.LockTask("fair", lock.WithProvider(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l, err := lock.LockTask("fair", lock.WithProvider(p), lock.WithFairness())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+			_ = l.Unlock()
+		}(i)
+		// make sure the tickets are registered in order
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// abandoned tickets don't block the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	go cancel()
+	if _, err := lock.LockTask("fair", lock.WithProvider(p), lock.WithFairness(), lock.WithContext(ctx)); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := lock.TryLockTask("fair", lock.WithProvider(p), lock.WithFairness()); err != lock.ErrLockFailed {
+		t.Fatalf("expected ErrLockFailed, got %v", err)
+	}
+
+	_ = holder.Unlock()
+	wg.Wait()
+	for i, o := range order {
+		if i != o {
+			t.Fatalf("lock not granted in arrival order: %v", order)
+		}
+	}
+}
+
+func TestMemoryLockExpiration(t *testing.T) {
+	p := NewMemoryLockProvider()
+	if _, err := lock.TryLockTask("expire", lock.WithProvider(p), lock.WithLockAtMost(50*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lock.LockTask("expire", lock.WithProvider(p), lock.WithLockTimeout(10*time.Millisecond)); err != lock.ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	l, err := lock.LockTask("expire", lock.WithProvider(p), lock.WithLockTimeout(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Unlock()
+}
+
+func TestMemoryLatchAndBarrier(t *testing.T) {
+	p := NewMemoryLockProvider()
+	latch, err := lock.NewCountDownLatch("latch", 3, p, lock.WithLockTimeout(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		go func() {
+			_ = latch.CountDown()
+		}()
+	}
+	if err := latch.Await(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the name is reused once the latch is deleted
+	if err := latch.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	next, err := lock.NewCountDownLatch("latch", 2, p, lock.WithLockTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := next.Count(); err != nil || c != 2 {
+		t.Fatalf("expected count 2, got %d, %v", c, err)
+	}
+	if err := next.Await(context.Background()); err != lock.ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+
+	barrier, err := lock.NewBarrier("barrier", 3, p, lock.WithLockTimeout(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := barrier.Await(context.Background()); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	timeout, err := lock.NewBarrier("barrier", 3, p, lock.WithLockTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := timeout.Await(context.Background()); err != lock.ErrTimeout {
+		t.Fatalf("expected ErrTimeout, got %v", err)
+	}
+
+	// the arrival left by the timed out party is gone once the barrier is deleted
+	if err := timeout.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := barrier.Await(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMemoryRunOnce(t *testing.T) {
+	p := NewMemoryLockProvider()
+	runs := 0
+	task := func(ctx context.Context) (string, error) {
+		runs++
+		return "done", nil
+	}
+	for i := 0; i < 3; i++ {
+		record, ran, err := lock.RunOnce("job-20210701", task, lock.WithProvider(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ran != (i == 0) || record.Status != lock.JobCompleted || record.Result != "done" {
+			t.Fatalf("unexpected run: %v, %+v", ran, record)
+		}
+	}
+	if _, ran, err := lock.RunOnce("job-20210701", task, lock.WithProvider(p), lock.WithForceRun()); err != nil || !ran {
+		t.Fatalf("forced run skipped: %v", err)
+	}
+	if runs != 2 {
+		t.Fatalf("expected 2 runs, got %d", runs)
+	}
+}
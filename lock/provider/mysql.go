@@ -5,11 +5,12 @@ User can custom table name, but should keep the same columns name as follows:
 package provider
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"github.com/chensk/go-swiss-knife/lock"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
 	"time"
 )
 
@@ -43,15 +44,14 @@ func (m mysqlLockProvider) Lock(conf lock.Configuration) (lock.Lock, error) {
 	if conf.LockAtMost == 0 {
 		return nil, lock.ErrLockAtMostMissing
 	}
+	if conf.Fair {
+		return m.fairLock(conf)
+	}
 	var loc LockModel
 	err := m.db.Model(LockModel{}).
 		Where("name = ? and lock_until >= ?", conf.Name, time.Now()).First(&loc).Error
-	timeoutWatcher := context.Background()
-	if conf.LockTimeout > 0 {
-		tw, f := context.WithTimeout(context.Background(), conf.LockTimeout)
-		defer f()
-		timeoutWatcher = tw
-	}
+	timeoutWatcher, cancel := conf.WaitContext()
+	defer cancel()
 	for {
 		for err == nil {
 			// keep waiting until lock is released
@@ -62,7 +62,7 @@ func (m mysqlLockProvider) Lock(conf lock.Configuration) (lock.Lock, error) {
 				err = m.db.Model(LockModel{}).
 					Where("name = ? and lock_until >= ?", conf.Name, time.Now()).First(&loc).Error
 			case <-timeoutWatcher.Done():
-				return nil, lock.ErrTimeout
+				return nil, lock.WaitErr(timeoutWatcher)
 			}
 		}
 
@@ -72,7 +72,7 @@ func (m mysqlLockProvider) Lock(conf lock.Configuration) (lock.Lock, error) {
 		lb, _ = lu.MarshalText()
 
 		var e error
-		if lockRegistry[conf.Name] {
+		if isRegistered(conf.Name) {
 			element := map[string]interface{}{
 				"locked_at": DbTime(time.Now()), "locked_by": conf.LockBy, "lock_until": string(lb),
 			}
@@ -80,7 +80,7 @@ func (m mysqlLockProvider) Lock(conf lock.Configuration) (lock.Lock, error) {
 				e = errors.New("")
 			}
 		} else {
-			lockRegistry[conf.Name] = true
+			register(conf.Name)
 			element := map[string]interface{}{
 				"name": conf.Name, "locked_at": DbTime(time.Now()), "locked_by": conf.LockBy, "lock_until": string(lb),
 			}
@@ -112,20 +112,171 @@ func (m mysqlLockProvider) TryLock(conf lock.Configuration) (lock.Lock, error) {
 		"lock_until": DbTime(time.Now().Add(conf.LockAtMost)),
 	}
 
-	if lockRegistry[conf.Name] {
+	if conf.Fair {
+		var waiting int64
+		if err := m.db.Model(WaiterModel{}).Where("name = ? and expires_at >= ?", conf.Name, time.Now()).Count(&waiting).Error; err != nil || waiting > 0 {
+			return nil, lock.ErrLockFailed
+		}
+	}
+	if isRegistered(conf.Name) {
 		if res := m.db.Model(LockModel{}).Where("name = ? and lock_until < ?", conf.Name, time.Now()).Updates(element); res.Error != nil || res.RowsAffected == 0 {
 			return nil, lock.ErrLockFailed
 		}
 		return mysqlLock{name: conf.Name, db: m.db}, nil
 	}
-	lockRegistry[conf.Name] = true
+	register(conf.Name)
 	if err := m.db.Model(LockModel{}).Create(element).Error; err != nil {
 		return nil, lock.ErrLockFailed
 	}
 	return mysqlLock{name: conf.Name, db: m.db}, nil
 }
 
+// fairLock registers a ticket for the waiter and tries to get the lock only when the ticket is the oldest alive one.
+// The ticket is kept alive while waiting and deleted once the lock is acquired or waiting is abandoned.
+func (m mysqlLockProvider) fairLock(conf lock.Configuration) (lock.Lock, error) {
+	ctx, cancel := conf.WaitContext()
+	defer cancel()
+	// clean the tickets abandoned by crashed waiters
+	_ = m.db.Where("name = ? and expires_at < ?", conf.Name, time.Now()).Delete(&WaiterModel{}).Error
+	ticket := WaiterModel{Name: conf.Name, WaitBy: conf.LockBy, ExpiresAt: DbTime(time.Now().Add(waiterLease))}
+	if err := m.db.Create(&ticket).Error; err != nil {
+		return nil, fmt.Errorf("fail to register waiter: %w", err)
+	}
+	defer func() {
+		_ = m.db.Delete(&WaiterModel{}, ticket.ID).Error
+	}()
+	unfair := conf
+	unfair.Fair = false
+	for {
+		var head WaiterModel
+		if err := m.db.Where("name = ? and expires_at >= ?", conf.Name, time.Now()).Order("id").First(&head).Error; err != nil {
+			return nil, fmt.Errorf("fail to query waiters: %w", err)
+		}
+		if head.ID == ticket.ID {
+			l, err := m.TryLock(unfair)
+			if err == nil {
+				return l, nil
+			}
+			if err != lock.ErrLockFailed {
+				return nil, err
+			}
+		}
+		select {
+		case <-time.After(fairPollInterval):
+		case <-ctx.Done():
+			return nil, lock.WaitErr(ctx)
+		}
+		err := m.db.Model(WaiterModel{}).Where("id = ?", ticket.ID).
+			Update("expires_at", DbTime(time.Now().Add(waiterLease))).Error
+		if err != nil {
+			return nil, fmt.Errorf("fail to keep waiter alive: %w", err)
+		}
+	}
+}
+
+func (m mysqlLockProvider) InitCounter(name string, value int64) error {
+	counter := CounterModel{Name: name, Value: value, UpdatedAt: DbTime(time.Now())}
+	if err := m.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&counter).Error; err != nil {
+		return fmt.Errorf("fail to init counter: %w", err)
+	}
+	return nil
+}
+
+func (m mysqlLockProvider) AddCounter(name string, delta int64) (int64, error) {
+	if err := m.InitCounter(name, 0); err != nil {
+		return 0, err
+	}
+	var counter CounterModel
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		// the updated row stays locked until commit, so the value read next is exactly the one we produced
+		err := tx.Model(CounterModel{}).Where("name = ?", name).Updates(map[string]interface{}{
+			"value": gorm.Expr("value + ?", delta), "updated_at": DbTime(time.Now()),
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("name = ?", name).First(&counter).Error
+	})
+	if err != nil {
+		return 0, fmt.Errorf("fail to add counter: %w", err)
+	}
+	return counter.Value, nil
+}
+
+func (m mysqlLockProvider) GetCounter(name string) (int64, error) {
+	var counter CounterModel
+	err := m.db.Where("name = ?", name).First(&counter).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("fail to get counter: %w", err)
+	}
+	return counter.Value, nil
+}
+
+func (m mysqlLockProvider) DeleteCounter(name string) error {
+	if err := m.db.Where("name = ?", name).Delete(&CounterModel{}).Error; err != nil {
+		return fmt.Errorf("fail to delete counter: %w", err)
+	}
+	return nil
+}
+
+func (m mysqlLockProvider) GetJob(key string) (lock.JobRecord, error) {
+	var job JobModel
+	err := m.db.Where("name = ?", key).First(&job).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return lock.JobRecord{}, lock.ErrJobNotFound
+	}
+	if err != nil {
+		return lock.JobRecord{}, fmt.Errorf("fail to get job: %w", err)
+	}
+	return lock.JobRecord{
+		Key:         job.Name,
+		Status:      lock.JobStatus(job.Status),
+		Result:      job.Result,
+		CompletedBy: job.CompletedBy,
+		CompletedAt: time.Time(job.CompletedAt),
+	}, nil
+}
+
+func (m mysqlLockProvider) SaveJob(record lock.JobRecord) error {
+	job := JobModel{
+		Name:        record.Key,
+		Status:      string(record.Status),
+		Result:      record.Result,
+		CompletedBy: record.CompletedBy,
+		CompletedAt: DbTime(record.CompletedAt),
+	}
+	err := m.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "result", "completed_by", "completed_at"}),
+	}).Create(&job).Error
+	if err != nil {
+		return fmt.Errorf("fail to save job: %w", err)
+	}
+	return nil
+}
+
+func isRegistered(name string) bool {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	return lockRegistry[name]
+}
+
+func register(name string) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	lockRegistry[name] = true
+}
+
+// fairPollInterval is the interval fair waiters check whether it's their turn
+const fairPollInterval = 100 * time.Millisecond
+
 var (
-	ErrEmptyName = errors.New("lock name empty")
-	lockRegistry = make(map[string]bool)
+	// waiterLease is how long a ticket stays alive without being refreshed by its waiter
+	waiterLease   = 10 * time.Second
+	ErrEmptyName  = errors.New("lock name empty")
+	lockRegistry  = make(map[string]bool)
+	registryMutex sync.Mutex
 )
@@ -0,0 +1,248 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"github.com/chensk/go-swiss-knife/lock"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newSqliteDB opens a sqlite database with the tables of the mysql provider. The connections are limited to one, so that
+// the concurrent waiters don't run into locked database errors.
+func newSqliteDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "lock.db")),
+		&gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		_ = sqlDB.Close()
+	})
+	for _, ddl := range []string{
+		`CREATE TABLE shedlock (id integer PRIMARY KEY AUTOINCREMENT, name varchar(64) NOT NULL UNIQUE,
+			lock_until datetime, locked_at datetime, locked_by varchar(255))`,
+		`CREATE TABLE shedlock_waiter (id integer PRIMARY KEY AUTOINCREMENT, name varchar(64) NOT NULL,
+			wait_by varchar(255), expires_at datetime)`,
+	} {
+		if err := db.Exec(ddl).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// uniqueName returns a lock name not used before, since the provider remembers the names created across databases.
+func uniqueName(prefix string) string {
+	return prefix + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// notifyWaiters sends to the returned channel once a waiter ticket is created.
+func notifyWaiters(t *testing.T, db *gorm.DB) <-chan struct{} {
+	registered := make(chan struct{}, 16)
+	err := db.Callback().Create().After("gorm:create").Register("test:waiter", func(tx *gorm.DB) {
+		if tx.Error == nil && tx.Statement.Table == (WaiterModel{}).TableName() {
+			registered <- struct{}{}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registered
+}
+
+func TestMysqlLockFairness(t *testing.T) {
+	db := newSqliteDB(t)
+	registered := notifyWaiters(t, db)
+	p := NewMysqlLockProvider(db)
+	name := uniqueName("mysql-fair")
+	options := []lock.Options{lock.WithProvider(p), lock.WithLockAtMost(time.Minute), lock.WithLockTimeout(10 * time.Second)}
+	fair := append(options[:len(options):len(options)], lock.WithFairness())
+	holder, err := lock.TryLockTask(name, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l, err := lock.LockTask(name, fair...)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+			_ = l.Unlock()
+		}(i)
+		// the next waiter starts only after the ticket of this one is registered
+		<-registered
+	}
+	if _, err := lock.TryLockTask(name, fair...); err != lock.ErrLockFailed {
+		t.Fatalf("expected ErrLockFailed, got %v", err)
+	}
+
+	_ = holder.Unlock()
+	wg.Wait()
+	if len(order) != 5 {
+		t.Fatalf("expected 5 waiters served, got %v", order)
+	}
+	for i, o := range order {
+		if i != o {
+			t.Fatalf("lock not granted in arrival order: %v", order)
+		}
+	}
+}
+
+func TestMysqlLockAbandonedWaiter(t *testing.T) {
+	lease := waiterLease
+	waiterLease = 300 * time.Millisecond
+	defer func() {
+		waiterLease = lease
+	}()
+	db := newSqliteDB(t)
+	p := NewMysqlLockProvider(db)
+	name := uniqueName("mysql-abandoned")
+	options := []lock.Options{lock.WithProvider(p), lock.WithLockAtMost(time.Minute), lock.WithLockTimeout(10 * time.Second),
+		lock.WithFairness()}
+
+	// the ticket of a crashed waiter, which is never refreshed
+	abandoned := WaiterModel{Name: name, WaitBy: "crashed", ExpiresAt: DbTime(time.Now().Add(waiterLease))}
+	if err := db.Create(&abandoned).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lock.TryLockTask(name, options...); err != lock.ErrLockFailed {
+		t.Fatalf("expected ErrLockFailed, got %v", err)
+	}
+
+	// the waiter keeps its own ticket alive, and is served once the abandoned ticket expires
+	l, err := lock.LockTask(name, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Now().Before(time.Time(abandoned.ExpiresAt)) {
+		t.Fatal("lock granted before the abandoned ticket expired")
+	}
+	_ = l.Unlock()
+
+	// the expired ticket is cleaned by the next waiter
+	l, err = lock.LockTask(name, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Unlock()
+	var tickets int64
+	if err := db.Model(WaiterModel{}).Where("name = ?", name).Count(&tickets).Error; err != nil {
+		t.Fatal(err)
+	}
+	if tickets != 0 {
+		t.Fatalf("expected no ticket left, got %d", tickets)
+	}
+}
+
+func TestMysqlCounter(t *testing.T) {
+	db := newSqliteDB(t)
+	// the table is created from the model, so that the unique index relied on by InitCounter is declared by it
+	if err := db.AutoMigrate(&CounterModel{}); err != nil {
+		t.Fatal(err)
+	}
+	p := NewMysqlLockProvider(db)
+	latch, err := lock.NewCountDownLatch("mysql-latch", 2, p, lock.WithLockTimeout(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// created by another node
+	if _, err := lock.NewCountDownLatch("mysql-latch", 2, p); err != nil {
+		t.Fatal(err)
+	}
+	var rows int64
+	if err := db.Model(CounterModel{}).Where("name = ?", "mysql-latch").Count(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("expected 1 counter row, got %d", rows)
+	}
+	for i := 0; i < 2; i++ {
+		if err := latch.CountDown(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := latch.Await(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := latch.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	next, err := lock.NewCountDownLatch("mysql-latch", 3, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := next.Count(); err != nil || c != 3 {
+		t.Fatalf("expected count 3, got %d, %v", c, err)
+	}
+}
+
+func TestMysqlRunOnce(t *testing.T) {
+	db := newSqliteDB(t)
+	// the table is created from the model, so that the unique index relied on by SaveJob is declared by it
+	if err := db.AutoMigrate(&JobModel{}); err != nil {
+		t.Fatal(err)
+	}
+	p := NewMysqlLockProvider(db)
+	key := uniqueName("mysql-job")
+	options := []lock.Options{lock.WithProvider(p), lock.WithLockAtMost(time.Minute)}
+	fail := true
+	runs := 0
+	task := func(ctx context.Context) (string, error) {
+		runs++
+		if fail {
+			return "", errors.New("boom")
+		}
+		return "done", nil
+	}
+
+	// failed jobs are run again
+	if record, ran, err := lock.RunOnce(key, task, options...); err == nil || !ran || record.Status != lock.JobFailed {
+		t.Fatalf("expected the job failed, got %+v, %v, %v", record, ran, err)
+	}
+	fail = false
+	for i := 0; i < 2; i++ {
+		record, ran, err := lock.RunOnce(key, task, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ran != (i == 0) || record.Status != lock.JobCompleted || record.Result != "done" {
+			t.Fatalf("unexpected run: %v, %+v", ran, record)
+		}
+	}
+	if _, ran, err := lock.RunOnce(key, task, append(options, lock.WithForceRun())...); err != nil || !ran {
+		t.Fatalf("forced run skipped: %v", err)
+	}
+	if runs != 3 {
+		t.Fatalf("expected 3 runs, got %d", runs)
+	}
+	var rows int64
+	if err := db.Model(JobModel{}).Where("name = ?", key).Count(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Fatalf("expected 1 job row, got %d", rows)
+	}
+}
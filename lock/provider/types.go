@@ -24,6 +24,55 @@ func (LockModel) TableName() string {
 	return "shedlock"
 }
 
+// WaiterModel is the ticket registered by a fair waiter. Among the alive tickets of a lock, the one with the smallest ID
+// is served first.
+type WaiterModel struct {
+	ID uint `gorm:"column:id;primaryKey;autoIncrement"`
+	// Name is identifier of the lock waited for.
+	Name string `gorm:"column:name"`
+	// WaitBy records the host ip of the waiter
+	WaitBy string `gorm:"column:wait_by"`
+	// ExpiresAt is refreshed by the waiter periodically, the ticket is considered abandoned once it passes.
+	ExpiresAt DbTime `gorm:"column:expires_at"`
+}
+
+func (WaiterModel) TableName() string {
+	return "shedlock_waiter"
+}
+
+// CounterModel is a named counter backing latches and barriers.
+type CounterModel struct {
+	ID uint `gorm:"column:id;primaryKey;autoIncrement"`
+	// Name is identifier of the counter, which is unique.
+	Name string `gorm:"column:name;uniqueIndex:uk_name"`
+	// Value is the current value of the counter.
+	Value int64 `gorm:"column:value"`
+	// UpdatedAt records the last time the counter changed.
+	UpdatedAt DbTime `gorm:"column:updated_at"`
+}
+
+func (CounterModel) TableName() string {
+	return "shedlock_counter"
+}
+
+// JobModel is the ledger entry recording the last run of a job.
+type JobModel struct {
+	ID uint `gorm:"column:id;primaryKey;autoIncrement"`
+	// Name is the key of the job, which is unique.
+	Name string `gorm:"column:name;uniqueIndex:uk_name"`
+	// Status is either completed or failed.
+	Status string `gorm:"column:status"`
+	// Result is the summary returned by the job, or the error message if failed.
+	Result string `gorm:"column:result"`
+	// CompletedBy records the host ip which ran the job.
+	CompletedBy string `gorm:"column:completed_by"`
+	CompletedAt DbTime `gorm:"column:completed_at"`
+}
+
+func (JobModel) TableName() string {
+	return "shedlock_job"
+}
+
 type DbTime time.Time
 
 func (dt DbTime) MarshalText() (data []byte, err error) {
@@ -0,0 +1,47 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// WithLock acquires the lock called name, runs task and always releases the lock, even if task panics, in which case
+// the panic is propagated after releasing. The context passed to task is cancelled when ctx is done or the lock is
+// lost because LockAtMost has elapsed. The errors of task and Unlock are combined into the returned error.
+func WithLock(ctx context.Context, name string, task func(ctx context.Context) error, options ...Options) error {
+	_, err := Do(ctx, name, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, task(ctx)
+	}, options...)
+	return err
+}
+
+// Do is like WithLock but propagates the result of task as well.
+func Do[T any](ctx context.Context, name string, task func(ctx context.Context) (T, error), options ...Options) (result T, err error) {
+	conf := Configuration{Name: name}
+	for _, opt := range options {
+		opt.Apply(&conf)
+	}
+	// options may be shared by the caller, so the context is appended to a copy
+	l, err := LockTask(name, append(append([]Options{}, options...), WithContext(ctx))...)
+	if err != nil {
+		return result, err
+	}
+	taskCtx, cancel := heldContext(ctx, conf.LockAtMost)
+	defer func() {
+		cancel()
+		if e := l.Unlock(); e != nil {
+			err = errors.Join(err, fmt.Errorf("fail to release lock %s: %w", name, e))
+		}
+	}()
+	return task(taskCtx)
+}
+
+// heldContext returns a context which is done once the lock acquired just now expires.
+func heldContext(ctx context.Context, atMost time.Duration) (context.Context, context.CancelFunc) {
+	if atMost > 0 {
+		return context.WithDeadline(ctx, time.Now().Add(atMost))
+	}
+	return context.WithCancel(ctx)
+}
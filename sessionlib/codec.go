@@ -0,0 +1,160 @@
+package sessionlib
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"reflect"
+)
+
+// Codec serializes the session values. Each value is encoded by Marshal when it's set, and the encoded values of a
+// session are put together by MarshalValues when the session is saved.
+type Codec interface {
+	// Marshal encodes a single value.
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes the data produced by Marshal into v, which must be a pointer.
+	Unmarshal(data []byte, v interface{}) error
+	// MarshalValues encodes the values of a session, each of which has been encoded by Marshal.
+	MarshalValues(values map[string][]byte) ([]byte, error)
+	// UnmarshalValues decodes the data produced by MarshalValues.
+	UnmarshalValues(data []byte) (map[string][]byte, error)
+}
+
+// JSONCodec encodes the session as a json object, which is the default codec and compatible with the sessions saved
+// by previous versions.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (JSONCodec) MarshalValues(values map[string][]byte) ([]byte, error) {
+	raw := make(map[string]json.RawMessage, len(values))
+	for k, v := range values {
+		raw[k] = v
+	}
+	return json.Marshal(raw)
+}
+
+func (JSONCodec) UnmarshalValues(data []byte) (map[string][]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(raw))
+	for k, v := range raw {
+		values[k] = v
+	}
+	return values, nil
+}
+
+// GobCodec encodes the session with encoding/gob. Values are encoded as interfaces so that they can be decoded without
+// knowing their types, hence custom types must be registered by gob.Register.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	var decoded interface{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&decoded); err != nil {
+		return err
+	}
+	return assign(v, decoded)
+}
+
+func (GobCodec) MarshalValues(values map[string][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) UnmarshalValues(data []byte) (map[string][]byte, error) {
+	var values map[string][]byte
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// MsgpackCodec encodes the session with MessagePack, which is more compact than json.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+func (MsgpackCodec) MarshalValues(values map[string][]byte) ([]byte, error) {
+	raw := make(map[string]msgpack.RawMessage, len(values))
+	for k, v := range values {
+		raw[k] = v
+	}
+	return msgpack.Marshal(raw)
+}
+
+func (MsgpackCodec) UnmarshalValues(data []byte) (map[string][]byte, error) {
+	var raw map[string]msgpack.RawMessage
+	if err := msgpack.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(raw))
+	for k, v := range raw {
+		values[k] = v
+	}
+	return values, nil
+}
+
+// GetAs gets the value of key from the session and decodes it into T, which is useful to get the structs stored in the
+// session. ErrValueNotFound is returned if key doesn't exist.
+func GetAs[T any](s Session, key string) (T, error) {
+	var v T
+	if d, ok := s.(valueDecoder); ok {
+		found, err := d.decode(key, &v)
+		if !found {
+			return v, ErrValueNotFound
+		}
+		return v, err
+	}
+	raw, ok := s.Get(key)
+	if !ok {
+		return v, ErrValueNotFound
+	}
+	return v, assign(&v, raw)
+}
+
+// valueDecoder is implemented by the sessions able to decode the values into specified types.
+type valueDecoder interface {
+	decode(key string, v interface{}) (bool, error)
+}
+
+// assign sets the value pointed to by ptr to v.
+func assign(ptr interface{}, v interface{}) error {
+	dst := reflect.ValueOf(ptr).Elem()
+	if v == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	src := reflect.ValueOf(v)
+	if !src.Type().AssignableTo(dst.Type()) {
+		return fmt.Errorf("value of type %s is not assignable to %s", src.Type(), dst.Type())
+	}
+	dst.Set(src)
+	return nil
+}
@@ -0,0 +1,202 @@
+package sessionlib
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// CookieSessionStore keeps the whole session on the client side, which suits stateless services. The serialized values
+// are signed with HMAC-SHA256, optionally encrypted with AES-GCM, and the resulting token is used as the session id,
+// so that it's written to the cookie by SessionIdSetter each time the session is saved.
+//
+// Keys can be rotated: the first key signs or encrypts the new tokens, while all the keys are tried when verifying.
+type CookieSessionStore struct {
+	signKeys  [][]byte
+	aeads     []cipher.AEAD
+	maxLength int
+}
+
+// NewCookieSessionStore creates the store signing the sessions with keys, each of which must be at least 32 bytes.
+func NewCookieSessionStore(keys [][]byte, options ...CookieStoreOptions) (*CookieSessionStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("signing key not found")
+	}
+	for _, key := range keys {
+		if len(key) < 32 {
+			return nil, errors.New("signing key shorter than 32 bytes")
+		}
+	}
+	opt := &cookieStoreOptions{MaxLength: 4000}
+	for _, o := range options {
+		o.apply(opt)
+	}
+	aeads, err := newAEADs(opt.EncryptionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return &CookieSessionStore{signKeys: keys, aeads: aeads, maxLength: opt.MaxLength}, nil
+}
+
+// token layout before base64url encoding: version | flags | expiry in unix milliseconds | payload | hmac
+const (
+	cookieVersion     byte = 1
+	cookieEncrypted   byte = 1
+	cookieHeaderSize       = 10
+	cookieMACSize          = sha256.Size
+	cookieNeverExpire      = 0
+)
+
+// Seal produces the token carrying value, which expires after expiration if positive.
+func (c *CookieSessionStore) Seal(value string, expiration time.Duration) (string, error) {
+	header := make([]byte, cookieHeaderSize)
+	header[0] = cookieVersion
+	var expiry int64 = cookieNeverExpire
+	if expiration > 0 {
+		expiry = time.Now().Add(expiration).UnixMilli()
+	}
+	binary.BigEndian.PutUint64(header[2:], uint64(expiry))
+	payload := []byte(value)
+	if len(c.aeads) > 0 {
+		header[1] |= cookieEncrypted
+		sealed, err := sealAEAD(c.aeads[0], payload, header)
+		if err != nil {
+			return "", err
+		}
+		payload = sealed
+	}
+	raw := append(header, payload...)
+	raw = append(raw, c.sign(c.signKeys[0], raw)...)
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	if c.maxLength > 0 && len(token) > c.maxLength {
+		return "", ErrCookieTooLarge
+	}
+	return token, nil
+}
+
+// Open verifies the token and returns the value it carries.
+func (c *CookieSessionStore) Open(token string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) < cookieHeaderSize+cookieMACSize || raw[0] != cookieVersion {
+		return "", ErrCookieInvalid
+	}
+	body, mac := raw[:len(raw)-cookieMACSize], raw[len(raw)-cookieMACSize:]
+	verified := false
+	for _, key := range c.signKeys {
+		if hmac.Equal(mac, c.sign(key, body)) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", ErrCookieInvalid
+	}
+	header, payload := body[:cookieHeaderSize], body[cookieHeaderSize:]
+	expiry := int64(binary.BigEndian.Uint64(header[2:]))
+	if expiry != cookieNeverExpire && time.Now().UnixMilli() >= expiry {
+		return "", ErrCookieExpired
+	}
+	if header[1]&cookieEncrypted == 0 {
+		return string(payload), nil
+	}
+	for _, aead := range c.aeads {
+		if plaintext, err := openAEAD(aead, payload, header); err == nil {
+			return string(plaintext), nil
+		}
+	}
+	return "", ErrCookieInvalid
+}
+
+func (c *CookieSessionStore) sign(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Get opens the token passed as key.
+func (c *CookieSessionStore) Get(ctx context.Context, key string) (string, error) {
+	if key == "" {
+		return "", ErrSessionNotFound
+	}
+	return c.Open(key)
+}
+
+// Set is not supported since the session id changes with the value, sessions call Seal instead.
+func (c *CookieSessionStore) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	return errCookieStoreWrite
+}
+
+// SetNX is not supported since the session id changes with the value, sessions call Seal instead.
+func (c *CookieSessionStore) SetNX(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	return false, errCookieStoreWrite
+}
+
+// Touch only verifies the token, the expiration can't be changed without sealing the value again, which is done by
+// sessions when they're saved.
+func (c *CookieSessionStore) Touch(ctx context.Context, key string, expiration time.Duration) error {
+	_, err := c.Get(ctx, key)
+	return err
+}
+
+// Delete does nothing, the cookie is removed by the client once the session id is cleared.
+func (c *CookieSessionStore) Delete(ctx context.Context, key string) error {
+	return nil
+}
+
+// tokenStore is implemented by stores keeping the session in the session id itself.
+type tokenStore interface {
+	Seal(value string, expiration time.Duration) (string, error)
+}
+
+type CookieStoreOptions interface {
+	apply(*cookieStoreOptions)
+}
+
+// WithCookieEncryption encrypts the sessions with AES-GCM besides signing. Each key must be 16, 24 or 32 bytes, the
+// first one encrypts the new tokens while all of them are tried when decrypting.
+func WithCookieEncryption(keys ...[]byte) CookieStoreOptions {
+	return newFuncCookieStoreOption(func(option *cookieStoreOptions) {
+		option.EncryptionKeys = keys
+	})
+}
+
+// WithCookieMaxLength specifies the maximum length of the tokens, 4000 by default since browsers limit the size of
+// cookies to 4096 bytes. Saving larger sessions fails with ErrCookieTooLarge. Non positive value means unlimited.
+func WithCookieMaxLength(length int) CookieStoreOptions {
+	return newFuncCookieStoreOption(func(option *cookieStoreOptions) {
+		option.MaxLength = length
+	})
+}
+
+type cookieStoreOptions struct {
+	EncryptionKeys [][]byte
+	MaxLength      int
+}
+
+type funcCookieStoreOption struct {
+	f func(option *cookieStoreOptions)
+}
+
+func (f *funcCookieStoreOption) apply(option *cookieStoreOptions) {
+	f.f(option)
+}
+
+func newFuncCookieStoreOption(f func(option *cookieStoreOptions)) CookieStoreOptions {
+	return &funcCookieStoreOption{f: f}
+}
+
+var (
+	// ErrCookieInvalid means the cookie is malformed or tampered with. Like ErrCookieExpired, it wraps
+	// ErrSessionNotFound so that CreateSession starts a new session.
+	ErrCookieInvalid  = fmt.Errorf("%w: cookie invalid or tampered with", ErrSessionNotFound)
+	ErrCookieExpired  = fmt.Errorf("%w: cookie expired", ErrSessionNotFound)
+	ErrCookieTooLarge = errors.New("session too large for cookie")
+
+	errCookieStoreWrite = errors.New("cookie store can't be written by key, use Seal instead")
+)
@@ -0,0 +1,65 @@
+package sessionlib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookieSessionStore(t *testing.T) {
+	oldKey, newKey := bytes.Repeat([]byte("o"), 32), bytes.Repeat([]byte("n"), 32)
+	encKey := bytes.Repeat([]byte("e"), 32)
+	oldStore, err := NewCookieSessionStore([][]byte{oldKey}, WithCookieEncryption(encKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewCookieSessionStore([][]byte{newKey, oldKey}, WithCookieEncryption(encKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sid string
+	getter := func() string {
+		return sid
+	}
+	setter := func(s string) {
+		sid = s
+	}
+	s, err := CreateSession(getter, setter, []SessionOptions{WithSessionStore(oldStore)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Set("user", "alice")
+	if err := s.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sid, "alice") || sid != s.SessionId() {
+		t.Fatalf("unexpected token: %s", sid)
+	}
+
+	// tokens signed by the old key are still accepted after rotation
+	s, err = CreateSession(getter, setter, []SessionOptions{WithSessionStore(store)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := s.Get("user"); !ok || v != "alice" {
+		t.Fatalf("session lost: %v", v)
+	}
+
+	tampered := []byte(sid)
+	tampered[len(tampered)/2] ^= 1
+	if _, err := store.Get(context.Background(), string(tampered)); !errors.Is(err, ErrCookieInvalid) {
+		t.Fatalf("expected ErrCookieInvalid, got %v", err)
+	}
+	token, _ := store.Seal("{}", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, err := store.Get(context.Background(), token); !errors.Is(err, ErrCookieExpired) || !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrCookieExpired, got %v", err)
+	}
+	if _, err := store.Seal(strings.Repeat("x", 4000), 0); err != ErrCookieTooLarge {
+		t.Fatalf("expected ErrCookieTooLarge, got %v", err)
+	}
+}
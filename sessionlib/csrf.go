@@ -0,0 +1,74 @@
+package sessionlib
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// csrfTokenKey keeps the CSRF token of the session.
+const csrfTokenKey = reservedKeyPrefix + "csrf_token"
+
+// ErrCSRFTokenInvalid means the request of unsafe method doesn't carry the CSRF token of the session, see
+// WithCSRFProtection.
+var ErrCSRFTokenInvalid = errors.New("csrf token invalid")
+
+func (s *session) CSRFToken() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if token := s.reserved(csrfTokenKey); token != "" {
+		return token, nil
+	}
+	var buf [32]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		return "", fmt.Errorf("fail to generate csrf token: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf[:])
+	raw, err := s.codec.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	s.values[csrfTokenKey] = raw
+	delete(s.cache, csrfTokenKey)
+	s.track(csrfTokenKey, false)
+	return token, nil
+}
+
+func (s *session) VerifyCSRF(token string) bool {
+	s.mutex.RLock()
+	expected := s.reserved(csrfTokenKey)
+	s.mutex.RUnlock()
+	if expected == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1
+}
+
+// safeMethod returns whether the requests of method don't change the state, which are not checked against CSRF.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// checkCSRF verifies the CSRF token carried by the request of unsafe method, which is read from the header, or the
+// form field if the header is absent.
+func (o *middlewareOptions) checkCSRF(r *http.Request, s Session) error {
+	if !o.CSRF || safeMethod(r.Method) {
+		return nil
+	}
+	token := r.Header.Get(o.CSRFHeader)
+	if token == "" && o.CSRFFormField != "" {
+		token = r.PostFormValue(o.CSRFFormField)
+	}
+	if !s.VerifyCSRF(token) {
+		return ErrCSRFTokenInvalid
+	}
+	return nil
+}
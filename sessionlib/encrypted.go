@@ -0,0 +1,328 @@
+package sessionlib
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// the encrypted payload: prefix | key id | : | base64(nonce | ciphertext)
+const encryptedPayloadPrefix = "enc1:"
+
+// encryptedStore encrypts the values of another store with AES-GCM, so that the session values are not readable from
+// the store. The id of the key is kept with each payload, so that the payloads encrypted by the keys rotated out can
+// still be decrypted as long as the keys are provided. The payloads are bound to their session ids, thus can't be
+// moved to other sessions.
+type encryptedStore struct {
+	store SessionStore
+	aeads []cipher.AEAD
+	// ids are the ids of the keys, i.e. the prefix of their sha256 hashes
+	ids     []string
+	options *encryptedStoreOptions
+}
+
+// encryptedVersionedStore is the encryptedStore of a VersionedSessionStore.
+type encryptedVersionedStore struct {
+	*encryptedStore
+	encryptedVersioning
+}
+
+// encryptedIndexedStore is the encryptedStore of a SessionIndex.
+type encryptedIndexedStore struct {
+	*encryptedStore
+	encryptedIndexing
+}
+
+// encryptedVersionedIndexedStore is the encryptedStore of a store which is both a VersionedSessionStore and a
+// SessionIndex.
+type encryptedVersionedIndexedStore struct {
+	*encryptedStore
+	encryptedVersioning
+	encryptedIndexing
+}
+
+// encryptedFieldStore is the encryptedStore of a FieldSessionStore, each value of which is encrypted separately.
+type encryptedFieldStore struct {
+	*encryptedStore
+	encryptedFields
+}
+
+// encryptedIndexedFieldStore is the encryptedStore of a FieldSessionStore which is a SessionIndex as well.
+type encryptedIndexedFieldStore struct {
+	*encryptedStore
+	encryptedFields
+	encryptedIndexing
+}
+
+// NewEncryptedSessionStore wraps store so that the values are encrypted with AES-GCM before written. Each key must be
+// 16, 24 or 32 bytes, the first one encrypts the values while all of them are tried when decrypting, hence the keys
+// can be rotated by putting the new one in front of the old ones, which can be removed once the sessions encrypted by
+// them expire.
+//
+// The wrapper is a VersionedSessionStore, FieldSessionStore or SessionIndex only if store is. The values of a
+// FieldSessionStore are encrypted field by field, and its versions are not exposed since such sessions are saved by
+// fields. The hooks registered on store by OnExpire or WithOnExpire are called for the sessions expired in the wrapper
+// as well.
+func NewEncryptedSessionStore(store SessionStore, keys [][]byte, options ...EncryptedStoreOptions) (SessionStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption key")
+	}
+	if _, ok := store.(tokenStore); ok {
+		return nil, errors.New("token store can't be encrypted, use WithCookieEncryption instead")
+	}
+	opt := &encryptedStoreOptions{}
+	for _, o := range options {
+		o.apply(opt)
+	}
+	aeads, err := newAEADs(keys)
+	if err != nil {
+		return nil, fmt.Errorf("fail to create cipher: %w", err)
+	}
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		sum := sha256.Sum256(key)
+		ids = append(ids, hex.EncodeToString(sum[:4]))
+	}
+	e := &encryptedStore{store: store, aeads: aeads, ids: ids, options: opt}
+	vs, versioned := store.(VersionedSessionStore)
+	index, indexed := store.(SessionIndex)
+	if fs, ok := store.(FieldSessionStore); ok {
+		if indexed {
+			return &encryptedIndexedFieldStore{e, encryptedFields{e, fs}, encryptedIndexing{index}}, nil
+		}
+		return &encryptedFieldStore{e, encryptedFields{e, fs}}, nil
+	}
+	switch {
+	case versioned && indexed:
+		return &encryptedVersionedIndexedStore{e, encryptedVersioning{e, vs}, encryptedIndexing{index}}, nil
+	case versioned:
+		return &encryptedVersionedStore{e, encryptedVersioning{e, vs}}, nil
+	case indexed:
+		return &encryptedIndexedStore{e, encryptedIndexing{index}}, nil
+	}
+	return e, nil
+}
+
+// encrypt encrypts value by the first key. additionalData binds the payload to the session.
+func (e *encryptedStore) encrypt(value []byte, additionalData string) ([]byte, error) {
+	sealed, err := sealAEAD(e.aeads[0], value, []byte(additionalData))
+	if err != nil {
+		return nil, fmt.Errorf("fail to encrypt session: %w", err)
+	}
+	header := encryptedPayloadPrefix + e.ids[0] + ":"
+	payload := make([]byte, len(header)+base64.RawStdEncoding.EncodedLen(len(sealed)))
+	copy(payload, header)
+	base64.RawStdEncoding.Encode(payload[len(header):], sealed)
+	return payload, nil
+}
+
+// decrypt decrypts the payload produced by encrypt, or returns the plaintext payload as it is if plaintext is allowed.
+func (e *encryptedStore) decrypt(payload []byte, additionalData string) ([]byte, error) {
+	rest, ok := strings.CutPrefix(string(payload), encryptedPayloadPrefix)
+	if !ok {
+		if e.options.PlaintextFallback {
+			return payload, nil
+		}
+		return nil, ErrPayloadInvalid
+	}
+	id, data, ok := strings.Cut(rest, ":")
+	if !ok {
+		return nil, ErrPayloadInvalid
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, ErrPayloadInvalid
+	}
+	for i, aead := range e.aeads {
+		if e.ids[i] != id {
+			continue
+		}
+		if plaintext, err := openAEAD(aead, sealed, []byte(additionalData)); err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, ErrPayloadInvalid
+}
+
+func (e *encryptedStore) encryptValue(key string, value string) (string, error) {
+	payload, err := e.encrypt([]byte(value), key)
+	return string(payload), err
+}
+
+func (e *encryptedStore) decryptValue(key string, value string) (string, error) {
+	plaintext, err := e.decrypt([]byte(value), key)
+	return string(plaintext), err
+}
+
+func (e *encryptedStore) Get(ctx context.Context, key string) (string, error) {
+	v, err := e.store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return e.decryptValue(key, v)
+}
+
+func (e *encryptedStore) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	payload, err := e.encryptValue(key, value)
+	if err != nil {
+		return err
+	}
+	return e.store.Set(ctx, key, payload, expiration)
+}
+
+func (e *encryptedStore) SetNX(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	payload, err := e.encryptValue(key, value)
+	if err != nil {
+		return false, err
+	}
+	return e.store.SetNX(ctx, key, payload, expiration)
+}
+
+func (e *encryptedStore) Touch(ctx context.Context, key string, expiration time.Duration) error {
+	return e.store.Touch(ctx, key, expiration)
+}
+
+func (e *encryptedStore) Delete(ctx context.Context, key string) error {
+	return e.store.Delete(ctx, key)
+}
+
+func (e *encryptedStore) addExpireHook(key interface{}, hook ExpireHook) {
+	if notifier, ok := e.store.(expiryNotifier); ok {
+		notifier.addExpireHook(key, hook)
+	}
+}
+
+func (e *encryptedStore) notifyExpired(sessionId string) {
+	if notifier, ok := e.store.(expiryNotifier); ok {
+		notifier.notifyExpired(sessionId)
+	}
+}
+
+// encryptedVersioning implements VersionedSessionStore for the encryptedStore of a VersionedSessionStore.
+type encryptedVersioning struct {
+	e     *encryptedStore
+	store VersionedSessionStore
+}
+
+// GetVersioned gets the value together with the version of the encrypted payload.
+func (v encryptedVersioning) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	value, version, err := v.store.GetVersioned(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+	value, err = v.e.decryptValue(key, value)
+	if err != nil {
+		return "", "", err
+	}
+	return value, version, nil
+}
+
+func (v encryptedVersioning) CompareAndSet(ctx context.Context, key string, value string, version string,
+	expiration time.Duration) (string, error) {
+	payload, err := v.e.encryptValue(key, value)
+	if err != nil {
+		return "", err
+	}
+	return v.store.CompareAndSet(ctx, key, payload, version, expiration)
+}
+
+// encryptedIndexing implements SessionIndex for the encryptedStore of a SessionIndex by delegating to it, since the
+// session index is not encrypted.
+type encryptedIndexing struct {
+	index SessionIndex
+}
+
+func (i encryptedIndexing) IndexSession(ctx context.Context, info SessionInfo) error {
+	return i.index.IndexSession(ctx, info)
+}
+
+func (i encryptedIndexing) UnindexSession(ctx context.Context, userId string, sessionId string) error {
+	return i.index.UnindexSession(ctx, userId, sessionId)
+}
+
+func (i encryptedIndexing) ListSessions(ctx context.Context, userId string) ([]SessionInfo, error) {
+	return i.index.ListSessions(ctx, userId)
+}
+
+func (i encryptedIndexing) RevokeAll(ctx context.Context, userId string) error {
+	return i.index.RevokeAll(ctx, userId)
+}
+
+// encryptedFields implements FieldSessionStore for the encryptedStore of a FieldSessionStore.
+type encryptedFields struct {
+	e      *encryptedStore
+	fields FieldSessionStore
+}
+
+// fieldAdditionalData binds the payload of a field to both the session and the field.
+func fieldAdditionalData(key string, field string) string {
+	return key + "\x00" + field
+}
+
+func (f encryptedFields) GetFields(ctx context.Context, key string) (map[string][]byte, error) {
+	fields, err := f.fields.GetFields(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for field, payload := range fields {
+		v, err := f.e.decrypt(payload, fieldAdditionalData(key, field))
+		if err != nil {
+			return nil, err
+		}
+		fields[field] = v
+	}
+	return fields, nil
+}
+
+func (f encryptedFields) UpdateFields(ctx context.Context, key string, set map[string][]byte, deleted []string,
+	replace bool, expiration time.Duration) error {
+	encrypted := make(map[string][]byte, len(set))
+	for field, v := range set {
+		payload, err := f.e.encrypt(v, fieldAdditionalData(key, field))
+		if err != nil {
+			return err
+		}
+		encrypted[field] = payload
+	}
+	return f.fields.UpdateFields(ctx, key, encrypted, deleted, replace, expiration)
+}
+
+type EncryptedStoreOptions interface {
+	apply(*encryptedStoreOptions)
+}
+
+// WithPlaintextFallback accepts the values saved without encryption, which are returned as they are, so that the
+// encryption can be enabled for the existing sessions. Without it, such sessions are regarded as invalid. It should be
+// removed once the plaintext sessions have been saved again or expired.
+func WithPlaintextFallback() EncryptedStoreOptions {
+	return newFuncEncryptedStoreOption(func(option *encryptedStoreOptions) {
+		option.PlaintextFallback = true
+	})
+}
+
+type encryptedStoreOptions struct {
+	PlaintextFallback bool
+}
+
+type funcEncryptedStoreOption struct {
+	f func(option *encryptedStoreOptions)
+}
+
+func (f *funcEncryptedStoreOption) apply(option *encryptedStoreOptions) {
+	f.f(option)
+}
+
+func newFuncEncryptedStoreOption(f func(option *encryptedStoreOptions)) EncryptedStoreOptions {
+	return &funcEncryptedStoreOption{f: f}
+}
+
+// ErrPayloadInvalid means the payload can't be decrypted, e.g. tampered with, encrypted by an unknown key or saved in
+// plaintext without WithPlaintextFallback. Like ErrCookieInvalid, it wraps ErrSessionNotFound so that CreateSession
+// starts a new session.
+var ErrPayloadInvalid = fmt.Errorf("%w: payload invalid or encrypted by unknown key", ErrSessionNotFound)
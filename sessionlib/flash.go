@@ -0,0 +1,39 @@
+package sessionlib
+
+// flashesKey keeps the flash messages of the session.
+const flashesKey = reservedKeyPrefix + "flashes"
+
+func (s *session) AddFlash(message string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	flashes := append(s.flashes(), message)
+	raw, err := s.codec.Marshal(flashes)
+	if err != nil {
+		return err
+	}
+	s.values[flashesKey] = raw
+	delete(s.cache, flashesKey)
+	s.track(flashesKey, false)
+	return nil
+}
+
+func (s *session) Flashes() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	flashes := s.flashes()
+	if _, ok := s.values[flashesKey]; ok {
+		delete(s.values, flashesKey)
+		delete(s.cache, flashesKey)
+		s.track(flashesKey, true)
+	}
+	return flashes
+}
+
+// flashes returns the flash messages. mutex must be held.
+func (s *session) flashes() []string {
+	var flashes []string
+	if raw, ok := s.values[flashesKey]; ok {
+		_ = s.codec.Unmarshal(raw, &flashes)
+	}
+	return flashes
+}
@@ -0,0 +1,405 @@
+package sessionlib
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strconv"
+	"time"
+)
+
+// SessionModel is the row of a session saved by GormSessionStore.
+type SessionModel struct {
+	// ID is the session id.
+	ID string `gorm:"column:id;primaryKey;size:255"`
+	// Data is the serialized session.
+	Data []byte `gorm:"column:data"`
+	// ExpiresAt is the expiration time in unix milliseconds, 0 means the session never expires.
+	ExpiresAt int64 `gorm:"column:expires_at;index"`
+	// Version is increased each time the session is set, which is used by CompareAndSet.
+	Version int64 `gorm:"column:version;not null;default:0"`
+}
+
+func (SessionModel) TableName() string {
+	return "sessions"
+}
+
+// SessionIndexModel is the row associating a session with a user, see SessionIndex.
+type SessionIndexModel struct {
+	SessionId string `gorm:"column:session_id;primaryKey;size:255"`
+	UserId    string `gorm:"column:user_id;index;size:255"`
+	// Created and LastSeen are in unix milliseconds.
+	Created   int64  `gorm:"column:created_at"`
+	LastSeen  int64  `gorm:"column:last_seen_at"`
+	IP        string `gorm:"column:ip;size:64"`
+	UserAgent string `gorm:"column:user_agent;size:512"`
+}
+
+func (SessionIndexModel) TableName() string {
+	return "session_index"
+}
+
+// GormSessionStore saves the sessions in the database through gorm, which works on mysql and sqlite. Expired rows are
+// invisible to Get, and deleted in batches by a background reaper until Close is called.
+type GormSessionStore struct {
+	db         *gorm.DB
+	table      string
+	indexTable string
+	options    *gormStoreOptions
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+// NewGormSessionStore creates the store with db, migrating the sessions table unless WithGormAutoMigrate(false) is
+// specified.
+func NewGormSessionStore(db *gorm.DB, options ...GormStoreOptions) (*GormSessionStore, error) {
+	opt := &gormStoreOptions{
+		TableName:      SessionModel{}.TableName(),
+		IndexTableName: SessionIndexModel{}.TableName(),
+		AutoMigrate:    true,
+		ReapInterval:   time.Minute,
+		ReapBatchSize:  500,
+	}
+	for _, o := range options {
+		o.apply(opt)
+	}
+	if opt.AutoMigrate {
+		if err := db.Table(opt.TableName).AutoMigrate(&SessionModel{}); err != nil {
+			return nil, fmt.Errorf("fail to migrate sessions table: %w", err)
+		}
+		if err := db.Table(opt.IndexTableName).AutoMigrate(&SessionIndexModel{}); err != nil {
+			return nil, fmt.Errorf("fail to migrate session index table: %w", err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &GormSessionStore{
+		db:         db,
+		table:      opt.TableName,
+		indexTable: opt.IndexTableName,
+		options:    opt,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	if opt.ReapInterval > 0 {
+		go g.reapLoop(ctx)
+	} else {
+		close(g.done)
+	}
+	return g, nil
+}
+
+func (g *GormSessionStore) session(ctx context.Context) *gorm.DB {
+	return g.db.WithContext(ctx).Table(g.table)
+}
+
+func (g *GormSessionStore) Get(ctx context.Context, key string) (string, error) {
+	model, err := g.find(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return string(model.Data), nil
+}
+
+// find gets the unexpired row of the session. Find is used rather than Take since missing sessions are common, which
+// shouldn't be logged as errors by gorm.
+func (g *GormSessionStore) find(ctx context.Context, key string) (SessionModel, error) {
+	var models []SessionModel
+	err := g.session(ctx).Where("id = ?", key).
+		Where("expires_at = 0 OR expires_at > ?", time.Now().UnixMilli()).
+		Limit(1).Find(&models).Error
+	if err != nil {
+		return SessionModel{}, err
+	}
+	if len(models) == 0 {
+		return SessionModel{}, ErrSessionNotFound
+	}
+	return models[0], nil
+}
+
+func (g *GormSessionStore) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	model := SessionModel{ID: key, Data: []byte(value), ExpiresAt: expiresAt(expiration), Version: 1}
+	return g.session(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "id"}},
+		DoUpdates: append(clause.AssignmentColumns([]string{"data", "expires_at"}),
+			clause.Assignment{Column: clause.Column{Name: "version"}, Value: gorm.Expr("version + 1")}),
+	}).Create(&model).Error
+}
+
+func (g *GormSessionStore) SetNX(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	model := SessionModel{ID: key, Data: []byte(value), ExpiresAt: expiresAt(expiration), Version: 1}
+	return g.insert(ctx, &model)
+}
+
+// insert adds the row if the session doesn't exist, returning whether it's added.
+func (g *GormSessionStore) insert(ctx context.Context, model *SessionModel) (bool, error) {
+	added := false
+	err := g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// the expired row is still there if it hasn't been reaped, which must not block the key
+		if err := tx.Table(g.table).Where("id = ?", model.ID).
+			Where("expires_at <> 0 AND expires_at <= ?", time.Now().UnixMilli()).
+			Delete(&SessionModel{}).Error; err != nil {
+			return err
+		}
+		result := tx.Table(g.table).Clauses(clause.OnConflict{DoNothing: true}).Create(model)
+		if result.Error != nil {
+			return result.Error
+		}
+		added = result.RowsAffected > 0
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return added, nil
+}
+
+func (g *GormSessionStore) Touch(ctx context.Context, key string, expiration time.Duration) error {
+	result := g.session(ctx).Where("id = ?", key).
+		Where("expires_at = 0 OR expires_at > ?", time.Now().UnixMilli()).
+		Update("expires_at", expiresAt(expiration))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
+	// mysql reports no affected rows if the value is unchanged, so check whether the key exists
+	_, err := g.Get(ctx, key)
+	return err
+}
+
+func (g *GormSessionStore) Delete(ctx context.Context, key string) error {
+	return g.session(ctx).Where("id = ?", key).Delete(&SessionModel{}).Error
+}
+
+func (g *GormSessionStore) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	model, err := g.find(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+	return string(model.Data), strconv.FormatInt(model.Version, 10), nil
+}
+
+func (g *GormSessionStore) CompareAndSet(ctx context.Context, key string, value string, version string,
+	expiration time.Duration) (string, error) {
+	if version == "" {
+		model := SessionModel{ID: key, Data: []byte(value), ExpiresAt: expiresAt(expiration), Version: 1}
+		added, err := g.insert(ctx, &model)
+		if err != nil {
+			return "", err
+		}
+		if !added {
+			return "", ErrSessionConflict
+		}
+		return "1", nil
+	}
+	current, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return "", ErrSessionConflict
+	}
+	result := g.session(ctx).Where("id = ? AND version = ?", key, current).
+		Where("expires_at = 0 OR expires_at > ?", time.Now().UnixMilli()).
+		Updates(map[string]interface{}{
+			"data":       []byte(value),
+			"expires_at": expiresAt(expiration),
+			"version":    current + 1,
+		})
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", ErrSessionConflict
+	}
+	return strconv.FormatInt(current+1, 10), nil
+}
+
+// Reap deletes the expired rows in batches together with their associations in the session index, returning the
+// number of sessions deleted.
+func (g *GormSessionStore) Reap(ctx context.Context) (int64, error) {
+	var total int64
+	for {
+		var ids []string
+		err := g.session(ctx).Where("expires_at <> 0 AND expires_at <= ?", time.Now().UnixMilli()).
+			Limit(g.options.ReapBatchSize).Pluck("id", &ids).Error
+		if err != nil {
+			return total, fmt.Errorf("fail to find expired sessions: %w", err)
+		}
+		if len(ids) == 0 {
+			return total, g.pruneIndex(ctx)
+		}
+		// the expiration is checked again in case the session is renewed in the meantime
+		result := g.session(ctx).Where("id IN ?", ids).
+			Where("expires_at <> 0 AND expires_at <= ?", time.Now().UnixMilli()).
+			Delete(&SessionModel{})
+		if result.Error != nil {
+			return total, fmt.Errorf("fail to delete expired sessions: %w", result.Error)
+		}
+		total += result.RowsAffected
+		if len(ids) < g.options.ReapBatchSize {
+			return total, g.pruneIndex(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		default:
+		}
+	}
+}
+
+// pruneIndex deletes the associations of the sessions which don't exist any more.
+func (g *GormSessionStore) pruneIndex(ctx context.Context) error {
+	err := g.db.WithContext(ctx).Table(g.indexTable).
+		Where("session_id NOT IN (?)", g.db.Table(g.table).Select("id")).
+		Delete(&SessionIndexModel{}).Error
+	if err != nil {
+		return fmt.Errorf("fail to prune session index: %w", err)
+	}
+	return nil
+}
+
+func (g *GormSessionStore) IndexSession(ctx context.Context, info SessionInfo) error {
+	model := SessionIndexModel{
+		SessionId: info.SessionId,
+		UserId:    info.UserId,
+		Created:   info.CreatedAt.UnixMilli(),
+		LastSeen:  info.LastSeen.UnixMilli(),
+		IP:        info.IP,
+		UserAgent: info.UserAgent,
+	}
+	return g.db.WithContext(ctx).Table(g.indexTable).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "session_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"user_id", "created_at", "last_seen_at", "ip", "user_agent"}),
+	}).Create(&model).Error
+}
+
+func (g *GormSessionStore) UnindexSession(ctx context.Context, userId string, sessionId string) error {
+	return g.db.WithContext(ctx).Table(g.indexTable).Where("session_id = ? AND user_id = ?", sessionId, userId).
+		Delete(&SessionIndexModel{}).Error
+}
+
+func (g *GormSessionStore) ListSessions(ctx context.Context, userId string) ([]SessionInfo, error) {
+	var models []SessionIndexModel
+	err := g.db.WithContext(ctx).Table(g.indexTable+" AS i").Select("i.*").
+		Joins("JOIN "+g.table+" AS s ON s.id = i.session_id").
+		Where("i.user_id = ?", userId).
+		Where("s.expires_at = 0 OR s.expires_at > ?", time.Now().UnixMilli()).
+		Find(&models).Error
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SessionInfo, 0, len(models))
+	for _, m := range models {
+		infos = append(infos, SessionInfo{
+			SessionId: m.SessionId,
+			UserId:    m.UserId,
+			CreatedAt: time.UnixMilli(m.Created),
+			LastSeen:  time.UnixMilli(m.LastSeen),
+			IP:        m.IP,
+			UserAgent: m.UserAgent,
+		})
+	}
+	return infos, nil
+}
+
+func (g *GormSessionStore) RevokeAll(ctx context.Context, userId string) error {
+	return g.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		sessions := tx.Table(g.indexTable).Select("session_id").Where("user_id = ?", userId)
+		if err := tx.Table(g.table).Where("id IN (?)", sessions).Delete(&SessionModel{}).Error; err != nil {
+			return err
+		}
+		return tx.Table(g.indexTable).Where("user_id = ?", userId).Delete(&SessionIndexModel{}).Error
+	})
+}
+
+func (g *GormSessionStore) reapLoop(ctx context.Context) {
+	defer close(g.done)
+	ticker := time.NewTicker(g.options.ReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, _ = g.Reap(ctx)
+		}
+	}
+}
+
+// Close stops the background reaper and waits for it to exit, the db is not closed.
+func (g *GormSessionStore) Close() error {
+	g.cancel()
+	<-g.done
+	return nil
+}
+
+// expiresAt converts expiration to the unix milliseconds saved in SessionModel.ExpiresAt.
+func expiresAt(expiration time.Duration) int64 {
+	if expiration <= 0 {
+		return 0
+	}
+	return time.Now().Add(expiration).UnixMilli()
+}
+
+type GormStoreOptions interface {
+	apply(*gormStoreOptions)
+}
+
+// WithGormTableName specifies the table of the sessions, sessions by default.
+func WithGormTableName(name string) GormStoreOptions {
+	return newFuncGormStoreOption(func(option *gormStoreOptions) {
+		option.TableName = name
+	})
+}
+
+// WithGormIndexTableName specifies the table associating the sessions with users, session_index by default.
+func WithGormIndexTableName(name string) GormStoreOptions {
+	return newFuncGormStoreOption(func(option *gormStoreOptions) {
+		option.IndexTableName = name
+	})
+}
+
+// WithGormAutoMigrate specifies whether to create or migrate the sessions table when the store is created, true by
+// default.
+func WithGormAutoMigrate(enabled bool) GormStoreOptions {
+	return newFuncGormStoreOption(func(option *gormStoreOptions) {
+		option.AutoMigrate = enabled
+	})
+}
+
+// WithGormReapInterval specifies how often the expired sessions are deleted, 1 minute by default. Non positive value
+// disables the background reaper, in which case Reap can be called manually.
+func WithGormReapInterval(interval time.Duration) GormStoreOptions {
+	return newFuncGormStoreOption(func(option *gormStoreOptions) {
+		option.ReapInterval = interval
+	})
+}
+
+// WithGormReapBatchSize specifies the maximum number of rows deleted by a statement when reaping, 500 by default.
+func WithGormReapBatchSize(size int) GormStoreOptions {
+	return newFuncGormStoreOption(func(option *gormStoreOptions) {
+		if size > 0 {
+			option.ReapBatchSize = size
+		}
+	})
+}
+
+type gormStoreOptions struct {
+	TableName      string
+	IndexTableName string
+	AutoMigrate    bool
+	ReapInterval   time.Duration
+	ReapBatchSize  int
+}
+
+type funcGormStoreOption struct {
+	f func(option *gormStoreOptions)
+}
+
+func (f *funcGormStoreOption) apply(option *gormStoreOptions) {
+	f.f(option)
+}
+
+func newFuncGormStoreOption(f func(option *gormStoreOptions)) GormStoreOptions {
+	return &funcGormStoreOption{f: f}
+}
@@ -0,0 +1,255 @@
+package sessionlib
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+	"sync"
+)
+
+// UnaryServerInterceptor returns a grpc unary server interceptor loading the session of each call with CreateSession.
+// The session id is read from the metadata, see WithMetadataKeys. Handlers can get the session by FromContext(ctx).
+// Modified sessions are saved automatically once the handler returns, and the id of the session created or
+// regenerated is sent in the response header.
+func UnaryServerInterceptor(options ...GRPCOptions) grpc.UnaryServerInterceptor {
+	opt := newGRPCOptions(options)
+	resolve := resolveOnce(opt.SessionOptions)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		call, err := opt.load(ctx, resolve)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := handler(call.ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		if err := call.commit(); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+}
+
+// StreamServerInterceptor returns a grpc stream server interceptor loading the session of each stream like
+// UnaryServerInterceptor. Modified sessions are saved right before the response header is sent, i.e. the first message
+// or SendHeader, or once the handler returns if nothing is sent.
+func StreamServerInterceptor(options ...GRPCOptions) grpc.StreamServerInterceptor {
+	opt := newGRPCOptions(options)
+	resolve := resolveOnce(opt.SessionOptions)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		call, err := opt.load(ss.Context(), resolve)
+		if err != nil {
+			return err
+		}
+		if err := handler(srv, &sessionServerStream{ServerStream: ss, call: call}); err != nil {
+			return err
+		}
+		return call.commit()
+	}
+}
+
+// UnaryClientInterceptor returns a grpc unary client interceptor forwarding the id of the session carried by the
+// context, e.g. the one loaded by Middleware or UnaryServerInterceptor, in the metadata, so that the downstream services
+// share the session. The id set in the outgoing metadata explicitly is not overridden.
+func UnaryClientInterceptor(options ...GRPCOptions) grpc.UnaryClientInterceptor {
+	opt := newGRPCOptions(options)
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		return invoker(opt.forward(ctx), method, req, reply, cc, callOpts...)
+	}
+}
+
+// StreamClientInterceptor returns a grpc stream client interceptor forwarding the session id like
+// UnaryClientInterceptor.
+func StreamClientInterceptor(options ...GRPCOptions) grpc.StreamClientInterceptor {
+	opt := newGRPCOptions(options)
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+		streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(opt.forward(ctx), desc, cc, method, callOpts...)
+	}
+}
+
+// grpcCall is the session of a call, which is saved and whose id is sent in the response header on commit.
+type grpcCall struct {
+	ctx     context.Context
+	options *grpcOptions
+	session *session
+
+	// mutex guards the id, which is set by the session
+	mutex sync.Mutex
+	id    string
+	idSet bool
+	// fresh is true if the session has been created by this call and the id has not been changed since then
+	fresh bool
+
+	once sync.Once
+	err  error
+}
+
+// load loads the session of the call whose context is ctx.
+func (o *grpcOptions) load(ctx context.Context, resolve func() ([]SessionOptions, error)) (*grpcCall, error) {
+	sessionOpts, err := resolve()
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "fail to resolve session store: %v", err)
+	}
+	call := &grpcCall{options: o}
+	s, err := CreateSession(func() string {
+		return o.readId(ctx)
+	}, func(id string) {
+		call.setId(id)
+	}, sessionOpts)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "fail to load session: %v", err)
+	}
+	// the id set while creating the session is sent only if the session gets stored
+	call.fresh = call.idSet
+	call.session = s.(*session)
+	call.ctx = NewContext(ctx, s)
+	return call, nil
+}
+
+func (c *grpcCall) setId(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.id = id
+	c.idSet = true
+	c.fresh = false
+}
+
+// commit saves the modified session and sets the session id in the response header if needed, only once.
+func (c *grpcCall) commit() error {
+	c.once.Do(func() {
+		c.session.mutex.RLock()
+		dirty := c.session.dirty
+		c.session.mutex.RUnlock()
+		if dirty {
+			if err := c.session.Save(c.ctx); err != nil {
+				c.err = status.Errorf(codes.Unavailable, "fail to save session: %v", err)
+				return
+			}
+		}
+		c.session.mutex.RLock()
+		persisted := c.session.persisted
+		c.session.mutex.RUnlock()
+		c.mutex.Lock()
+		id, send := c.id, c.idSet && (!c.fresh || persisted)
+		c.mutex.Unlock()
+		if send {
+			c.err = grpc.SetHeader(c.ctx, metadata.Pairs(c.options.MetadataKeys[0], id))
+		}
+	})
+	return c.err
+}
+
+// sessionServerStream carries the session in its context, and commits it before the response header is sent.
+type sessionServerStream struct {
+	grpc.ServerStream
+	call *grpcCall
+}
+
+func (s *sessionServerStream) Context() context.Context {
+	return s.call.ctx
+}
+
+func (s *sessionServerStream) SendHeader(md metadata.MD) error {
+	if err := s.call.commit(); err != nil {
+		return err
+	}
+	return s.ServerStream.SendHeader(md)
+}
+
+func (s *sessionServerStream) SendMsg(m interface{}) error {
+	if err := s.call.commit(); err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+type GRPCOptions interface {
+	apply(*grpcOptions)
+}
+
+// WithMetadataKeys specifies the metadata keys carrying the session id, "session-id" by default. The server
+// interceptors read the id from the first key present, while the id is sent in the response header and forwarded by
+// the client interceptors with the first key.
+func WithMetadataKeys(keys ...string) GRPCOptions {
+	return newFuncGRPCOption(func(option *grpcOptions) {
+		if len(keys) == 0 {
+			return
+		}
+		option.MetadataKeys = make([]string, 0, len(keys))
+		for _, key := range keys {
+			// metadata keys are case insensitive, and stored in lowercase
+			option.MetadataKeys = append(option.MetadataKeys, strings.ToLower(key))
+		}
+	})
+}
+
+// WithGRPCSessionOptions specifies the options passed to CreateSession by the server interceptors.
+func WithGRPCSessionOptions(options ...SessionOptions) GRPCOptions {
+	return newFuncGRPCOption(func(option *grpcOptions) {
+		option.SessionOptions = append(option.SessionOptions, options...)
+	})
+}
+
+type grpcOptions struct {
+	MetadataKeys   []string
+	SessionOptions []SessionOptions
+}
+
+func newGRPCOptions(options []GRPCOptions) *grpcOptions {
+	opt := &grpcOptions{MetadataKeys: []string{"session-id"}}
+	for _, o := range options {
+		o.apply(opt)
+	}
+	return opt
+}
+
+func (o *grpcOptions) readId(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, key := range o.MetadataKeys {
+		if values := md.Get(key); len(values) != 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// forward adds the id of the session carried by ctx to the outgoing metadata unless it's there.
+func (o *grpcOptions) forward(ctx context.Context) context.Context {
+	s := FromContext(ctx)
+	if s == nil {
+		return ctx
+	}
+	id := s.SessionId()
+	if id == "" {
+		return ctx
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		for _, key := range o.MetadataKeys {
+			if len(md.Get(key)) != 0 {
+				return ctx
+			}
+		}
+	}
+	return metadata.AppendToOutgoingContext(ctx, o.MetadataKeys[0], id)
+}
+
+type funcGRPCOption struct {
+	f func(option *grpcOptions)
+}
+
+func (f *funcGRPCOption) apply(option *grpcOptions) {
+	f.f(option)
+}
+
+func newFuncGRPCOption(f func(option *grpcOptions)) GRPCOptions {
+	return &funcGRPCOption{f: f}
+}
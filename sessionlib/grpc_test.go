@@ -0,0 +1,129 @@
+package sessionlib
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"sync"
+	"testing"
+)
+
+// newBufconnClient serves the health service with the session interceptors in process, returning the client and the
+// session seen by the last call.
+func newBufconnClient(t *testing.T, store SessionStore, clientOptions ...grpc.DialOption) (grpc_health_v1.HealthClient,
+	func() Session) {
+	var mutex sync.Mutex
+	var last Session
+	record := func(ctx context.Context) {
+		s := FromContext(ctx)
+		n, _ := GetAs[int](s, "calls")
+		_ = s.Set("calls", n+1)
+		mutex.Lock()
+		defer mutex.Unlock()
+		last = s
+	}
+	options := []GRPCOptions{WithGRPCSessionOptions(WithSessionStore(store)), WithMetadataKeys("Session-Id", "x-session")}
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(UnaryServerInterceptor(options...), func(ctx context.Context, req interface{},
+			info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			record(ctx)
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(StreamServerInterceptor(options...), func(srv interface{}, ss grpc.ServerStream,
+			info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			record(ss.Context())
+			return handler(srv, ss)
+		}),
+	)
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+	listener := bufconn.Listen(1 << 20)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	dialOptions := append([]grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, clientOptions...)
+	conn, err := grpc.Dial("bufnet", dialOptions...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return grpc_health_v1.NewHealthClient(conn), func() Session {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return last
+	}
+}
+
+func TestGRPCInterceptors(t *testing.T) {
+	store := NewInMemorySessionStore()
+	defer store.Close()
+	client, last := newBufconnClient(t, store,
+		grpc.WithChainUnaryInterceptor(UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(StreamClientInterceptor()))
+	ctx := context.Background()
+
+	// the id of the session created is sent in the header
+	var header metadata.MD
+	if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.Header(&header)); err != nil {
+		t.Fatal(err)
+	}
+	ids := header.Get("session-id")
+	if len(ids) != 1 || ids[0] != last().SessionId() {
+		t.Fatalf("expected the session id in header, got %v", ids)
+	}
+	sid := ids[0]
+
+	// the session is loaded by the id from any of the keys
+	header = nil
+	callCtx := metadata.AppendToOutgoingContext(ctx, "x-session", sid)
+	if _, err := client.Check(callCtx, &grpc_health_v1.HealthCheckRequest{}, grpc.Header(&header)); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := GetAs[int](last(), "calls"); n != 2 || last().SessionId() != sid {
+		t.Fatalf("expected the session loaded, got %v calls of %v", n, last().SessionId())
+	}
+	if len(header.Get("session-id")) != 0 {
+		t.Fatal("expected no session id in header for the existing session")
+	}
+
+	// streams
+	streamCtx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(ctx, "session-id", sid))
+	stream, err := client.Watch(streamCtx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	s, err := CreateSession(func() string {
+		return sid
+	}, nil, []SessionOptions{WithSessionStore(store)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := GetAs[int](s, "calls"); n != 3 {
+		t.Fatalf("expected the session saved by stream, got %v calls", n)
+	}
+
+	// the session carried by the context is forwarded by the client interceptors
+	if _, err := client.Check(NewContext(ctx, s), &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if last().SessionId() != sid {
+		t.Fatalf("expected the session forwarded, got %v", last().SessionId())
+	}
+}
@@ -0,0 +1,85 @@
+package sessionlib
+
+import (
+	"context"
+	"sync"
+)
+
+// SessionHook is called on the lifecycle events of a session, see WithOnCreate, WithOnSave and WithOnDestroy. It's
+// called synchronously by the goroutine operating the session, after the operation succeeds.
+type SessionHook func(ctx context.Context, s Session)
+
+// ExpireHook is called with the id of the session expired, see WithOnExpire.
+type ExpireHook func(sessionId string)
+
+// expiryNotifier is implemented by the stores able to notify the expiration of sessions, including the wrappers of
+// such stores.
+type expiryNotifier interface {
+	// addExpireHook registers hook, the hooks registered with the same non-nil key are registered only once.
+	addExpireHook(key interface{}, hook ExpireHook)
+	// notifyExpired calls the hooks registered on the store with the id of the session found expired by CreateSession.
+	notifyExpired(sessionId string)
+}
+
+// expireHooks holds the hooks registered on a store. The zero value is ready to use.
+type expireHooks struct {
+	mutex sync.RWMutex
+	keys  map[interface{}]struct{}
+	hooks []ExpireHook
+}
+
+func (h *expireHooks) add(key interface{}, hook ExpireHook) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if key != nil {
+		if _, ok := h.keys[key]; ok {
+			return
+		}
+		if h.keys == nil {
+			h.keys = make(map[interface{}]struct{})
+		}
+		h.keys[key] = struct{}{}
+	}
+	h.hooks = append(h.hooks, hook)
+}
+
+func (h *expireHooks) fire(sessionId string) {
+	h.mutex.RLock()
+	hooks := h.hooks
+	h.mutex.RUnlock()
+	for _, hook := range hooks {
+		hook(sessionId)
+	}
+}
+
+// sessionHooks are the hooks of a session specified by options.
+type sessionHooks struct {
+	OnCreate  []SessionHook
+	OnSave    []SessionHook
+	OnDestroy []SessionHook
+	OnExpire  []registeredExpireHook
+}
+
+// registeredExpireHook is the hook specified by WithOnExpire, whose key is the option so that reusing the option
+// doesn't register the hook repeatedly.
+type registeredExpireHook struct {
+	key  interface{}
+	hook ExpireHook
+}
+
+func fireSessionHooks(ctx context.Context, hooks []SessionHook, s Session) {
+	for _, hook := range hooks {
+		hook(ctx, s)
+	}
+}
+
+// registerExpireHooks registers the hooks specified by WithOnExpire on the store if it can notify the expiration.
+func registerExpireHooks(store SessionStore, hooks []registeredExpireHook) {
+	notifier, ok := store.(expiryNotifier)
+	if !ok {
+		return
+	}
+	for _, h := range hooks {
+		notifier.addExpireHook(h.key, h.hook)
+	}
+}
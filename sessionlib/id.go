@@ -0,0 +1,91 @@
+package sessionlib
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// SessionIdGenerator generates the ids of new sessions, see WithSessionIdGenerator. Custom generators can be used to
+// produce ids in other formats, e.g. with a prefix identifying the node.
+type SessionIdGenerator interface {
+	// Generate generates a new id, which must be unpredictable. The error is returned by the session operation
+	// generating the id.
+	Generate() (string, error)
+	// Validate returns whether id is well-formed, i.e. may have been generated by Generate. The ids received by
+	// CreateSession are validated before the store is accessed, and a new session is created for malformed ones.
+	Validate(id string) bool
+}
+
+// UUIDGenerator generates random UUIDs (version 4) such as "0b7d3a52-9b7c-4b1e-8f3a-2c1d5e6f7a8b", which is the
+// default generator and compatible with the ids generated by previous versions.
+type UUIDGenerator struct{}
+
+func (UUIDGenerator) Generate() (string, error) {
+	return newUUID()
+}
+
+func (UUIDGenerator) Validate(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+				return false
+			}
+		}
+	}
+	return id[14] == '4' && (id[19] == '8' || id[19] == '9' || id[19] == 'a' || id[19] == 'b')
+}
+
+// Base64IdGenerator generates 256-bit random ids encoded by unpadded base64url, 43 characters long.
+type Base64IdGenerator struct{}
+
+const base64IdSize = 32
+
+func (Base64IdGenerator) Generate() (string, error) {
+	var buf [base64IdSize]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		return "", fmt.Errorf("fail to generate session id: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+func (Base64IdGenerator) Validate(id string) bool {
+	if len(id) != base64.RawURLEncoding.EncodedLen(base64IdSize) {
+		return false
+	}
+	_, err := base64.RawURLEncoding.Strict().DecodeString(id)
+	return err == nil
+}
+
+func newUUID() (string, error) {
+	var buf [16]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		return "", fmt.Errorf("fail to generate session id: %w", err)
+	}
+	buf[6] = (buf[6] & 0x0f) | 0x40
+	buf[8] = (buf[8] & 0x3f) | 0x80
+
+	dst := make([]byte, 36)
+	hex.Encode(dst, buf[:4])
+	dst[8] = '-'
+	hex.Encode(dst[9:13], buf[4:6])
+	dst[13] = '-'
+	hex.Encode(dst[14:18], buf[6:8])
+	dst[18] = '-'
+	hex.Encode(dst[19:23], buf[8:10])
+	dst[23] = '-'
+	hex.Encode(dst[24:], buf[10:])
+
+	return string(dst), nil
+}
@@ -1,115 +1,530 @@
 package sessionlib
 
 import (
+	"container/heap"
 	"container/list"
 	"context"
-	"errors"
+	"strconv"
 	"sync"
 	"time"
 )
 
 var (
-	_store *InMemorySessionStore
-	once   sync.Once
+	defaultMemoryStore     *InMemorySessionStore
+	defaultMemoryStoreOnce sync.Once
 )
 
-// link list
-type Element struct {
+// sharedMemoryStore returns the store used by CreateSession if no store is specified, which is created on first use
+// and shared by the whole process.
+func sharedMemoryStore() *InMemorySessionStore {
+	defaultMemoryStoreOnce.Do(func() {
+		defaultMemoryStore = NewInMemorySessionStore()
+	})
+	return defaultMemoryStore
+}
+
+// memoryEntry is a session kept by InMemorySessionStore.
+type memoryEntry struct {
 	key      string
 	value    string
 	deadline time.Time
+	version  uint64
+	// index is the position in the expiry heap, -1 if the entry never expires
+	index int
+	// element is the position in the lru list
+	element *list.Element
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.deadline.IsZero() && !e.deadline.After(now)
+}
+
+// expiryHeap orders the entries by deadline so that gc only needs to look at the top.
+type expiryHeap []*memoryEntry
+
+func (h expiryHeap) Len() int {
+	return len(h)
+}
+
+func (h expiryHeap) Less(i, j int) bool {
+	return h[i].deadline.Before(h[j].deadline)
 }
 
-// InMemorySessionStore stores the session in local memory.
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	e := x.(*memoryEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*h = old[:len(old)-1]
+	return e
+}
+
+// MemoryStoreStats is the statistics of InMemorySessionStore.
+type MemoryStoreStats struct {
+	// Entries is the number of sessions kept, including the expired ones not removed yet.
+	Entries int
+	// Evictions is the number of sessions evicted since the store is created because of WithMaxEntries.
+	Evictions uint64
+	// Expirations is the number of expired sessions removed since the store is created.
+	Expirations uint64
+	// SnapshotFailures is the number of periodic snapshots failed because of WithSnapshotFile.
+	SnapshotFailures uint64
+}
+
+// InMemorySessionStore stores the session in local memory. Expired sessions are removed by a background goroutine
+// until Close is called, and the least recently used sessions are evicted if the number of sessions exceeds the limit
+// specified by WithMaxEntries. All the operations take O(log n) time.
 type InMemorySessionStore struct {
-	mutex sync.RWMutex
-	data  map[string]Element
-	// link list is used to keep the elements order by its deadline so that gc can focus only on the first element of list
-	list *list.List
+	mutex sync.Mutex
+	data  map[string]*memoryEntry
+	// expiry keeps the entries which expire, ordered by deadline
+	expiry expiryHeap
+	// lru keeps the entries ordered by access, the most recent one at front
+	lru        *list.List
+	maxEntries int
+	// version is the last version assigned to the entries
+	version uint64
+	stats   MemoryStoreStats
+	// index maps the users to their sessions, and users maps the sessions to their users, so that the associations
+	// are removed together with the sessions
+	index map[string]map[string]SessionInfo
+	users map[string]string
+	// expired keeps the keys expired since gc ran last time, whose hooks are called by gc, or by unlock once the store
+	// is closed
+	expired []string
+	hooks   expireHooks
+
+	// snapshotPath is the file written periodically and on Close, empty if not specified
+	snapshotPath string
+
+	// wake notifies gc that the earliest deadline has changed
+	wake         chan struct{}
+	stop         chan struct{}
+	done         chan struct{}
+	snapshotDone chan struct{}
+	closeOnce    sync.Once
+	closeErr     error
 }
 
-func NewInMemorySessionStore() SessionStore {
-	once.Do(func() {
-		_store = &InMemorySessionStore{
-			data: make(map[string]Element),
-			list: list.New(),
+// NewInMemorySessionStore creates an independent store, which should be closed by Close once it's not used any more.
+// The sessions of the previous process can be loaded by RestoreFile if WithSnapshotFile is specified.
+func NewInMemorySessionStore(options ...MemoryStoreOptions) *InMemorySessionStore {
+	opt := &memoryStoreOptions{}
+	for _, o := range options {
+		o.apply(opt)
+	}
+	s := &InMemorySessionStore{
+		data:         make(map[string]*memoryEntry),
+		lru:          list.New(),
+		index:        make(map[string]map[string]SessionInfo),
+		users:        make(map[string]string),
+		maxEntries:   opt.MaxEntries,
+		snapshotPath: opt.SnapshotPath,
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+		snapshotDone: make(chan struct{}),
+	}
+	go s.gc()
+	if opt.SnapshotPath != "" && opt.SnapshotInterval > 0 {
+		go s.snapshotLoop(opt.SnapshotPath, opt.SnapshotInterval)
+	} else {
+		close(s.snapshotDone)
+	}
+	return s
+}
+
+// Close stops the background goroutines removing expired sessions and writing snapshots. The store is still usable,
+// while expired sessions are removed only when accessed, calling the hooks right away. If WithSnapshotFile is
+// specified, the final snapshot is written, whose error is returned.
+func (s *InMemorySessionStore) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.snapshotDone
+		if s.snapshotPath != "" {
+			s.closeErr = s.SnapshotFile(s.snapshotPath)
 		}
-		go _store.gc()
 	})
-	return _store
+	<-s.done
+	// the hooks of the entries expired after gc ran last time
+	s.mutex.Lock()
+	s.unlock()
+	return s.closeErr
+}
+
+// Stats returns the statistics of the store.
+func (s *InMemorySessionStore) Stats() MemoryStoreStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	stats.Entries = len(s.data)
+	return stats
 }
 
-// gc deletes the expired elements
+// gc removes the expired entries and calls the hooks registered by OnExpire, sleeping until the earliest deadline.
 func (s *InMemorySessionStore) gc() {
-	defaultPeriod := 1 * time.Second
+	defer close(s.done)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
 	for {
-		func() {
-			if s.list.Front() == nil {
-				time.Sleep(defaultPeriod)
-				return
-			}
-			head := s.list.Front().Value.(Element)
-			if head.deadline.After(time.Now()) {
-				time.Sleep(head.deadline.Sub(time.Now()))
-				return
+		s.mutex.Lock()
+		now := time.Now()
+		for len(s.expiry) > 0 && s.expiry[0].expired(now) {
+			s.expire(s.expiry[0])
+		}
+		wait := time.Hour
+		if len(s.expiry) > 0 {
+			wait = s.expiry[0].deadline.Sub(now)
+		}
+		expired := s.expired
+		s.expired = nil
+		s.mutex.Unlock()
+		for _, key := range expired {
+			s.hooks.fire(key)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
-			s.mutex.Lock()
-			defer s.mutex.Unlock()
-			// delete head
-			delete(s.data, head.key)
-			s.list.Remove(s.list.Front())
-		}()
+		}
+		timer.Reset(wait)
+		select {
+		case <-s.stop:
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
 	}
 }
 
 func (s *InMemorySessionStore) Get(ctx context.Context, key string) (string, error) {
-	s.mutex.RLock()
-	v, ok := s.data[key]
-	s.mutex.RUnlock()
-	if !ok {
-		return "", errors.New("not found")
+	s.mutex.Lock()
+	defer s.unlock()
+	e := s.lookup(key)
+	if e == nil {
+		return "", ErrSessionNotFound
 	}
-	return v.value, nil
+	return e.value, nil
 }
 
 func (s *InMemorySessionStore) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
-	if _, ok := s.data[key]; ok {
-		return nil
+	s.mutex.Lock()
+	defer s.unlock()
+	s.put(key, value, s.nextVersion(), expiration)
+	return nil
+}
+
+func (s *InMemorySessionStore) SetNX(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+	if s.lookup(key) != nil {
+		return false, nil
 	}
+	s.put(key, value, s.nextVersion(), expiration)
+	return true, nil
+}
+
+func (s *InMemorySessionStore) Touch(ctx context.Context, key string, expiration time.Duration) error {
 	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	ele := Element{
-		value:    value,
-		key:      key,
-		deadline: time.Now().Add(expiration),
-	}
-	s.data[key] = ele
-	// insert into list ordered by deadline
-	newEle := s.list.PushFront(ele)
-	var start *list.Element
-	for start = newEle; start.Next() != nil; start = start.Next() {
-		if start.Next().Value.(Element).deadline.Before(newEle.Value.(Element).deadline) {
-			continue
-		}
-		break
+	defer s.unlock()
+	e := s.lookup(key)
+	if e == nil {
+		return ErrSessionNotFound
 	}
-	s.list.MoveAfter(newEle, start)
+	s.put(key, e.value, e.version, expiration)
 	return nil
 }
 
 func (s *InMemorySessionStore) Delete(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.unlock()
+	if e, ok := s.data[key]; ok {
+		s.remove(e)
+	}
+	return nil
+}
+
+func (s *InMemorySessionStore) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+	e := s.lookup(key)
+	if e == nil {
+		return "", "", ErrSessionNotFound
+	}
+	return e.value, strconv.FormatUint(e.version, 10), nil
+}
+
+func (s *InMemorySessionStore) CompareAndSet(ctx context.Context, key string, value string, version string,
+	expiration time.Duration) (string, error) {
+	s.mutex.Lock()
+	defer s.unlock()
+	current := ""
+	if e := s.lookup(key); e != nil {
+		current = strconv.FormatUint(e.version, 10)
+	}
+	if current != version {
+		return "", ErrSessionConflict
+	}
+	next := s.nextVersion()
+	s.put(key, value, next, expiration)
+	return strconv.FormatUint(next, 10), nil
+}
+
+func (s *InMemorySessionStore) IndexSession(ctx context.Context, info SessionInfo) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.indexSession(info)
+	return nil
+}
+
+// indexSession associates the session with the user. mutex must be held.
+func (s *InMemorySessionStore) indexSession(info SessionInfo) {
+	if userId, ok := s.users[info.SessionId]; ok && userId != info.UserId {
+		s.unindex(userId, info.SessionId)
+	}
+	sessions, ok := s.index[info.UserId]
+	if !ok {
+		sessions = make(map[string]SessionInfo)
+		s.index[info.UserId] = sessions
+	}
+	sessions[info.SessionId] = info
+	s.users[info.SessionId] = info.UserId
+}
+
+func (s *InMemorySessionStore) UnindexSession(ctx context.Context, userId string, sessionId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.unindex(userId, sessionId)
+	return nil
+}
+
+func (s *InMemorySessionStore) ListSessions(ctx context.Context, userId string) ([]SessionInfo, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	delete(s.data, key)
-	// delete from list
-	var start *list.Element
-	for start = s.list.Front(); start != nil; start = start.Next() {
-		if start.Value.(Element).key == key {
-			break
+	now := time.Now()
+	var infos []SessionInfo
+	for sid, info := range s.index[userId] {
+		if e, ok := s.data[sid]; ok && !e.expired(now) {
+			infos = append(infos, info)
 		}
 	}
-	if start != nil && start.Value.(Element).key == key {
-		s.list.Remove(start)
+	return infos, nil
+}
+
+func (s *InMemorySessionStore) RevokeAll(ctx context.Context, userId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for sid := range s.index[userId] {
+		if e, ok := s.data[sid]; ok {
+			s.remove(e)
+		} else {
+			s.unindex(userId, sid)
+		}
 	}
 	return nil
 }
+
+// unindex removes the association of the session with the user. mutex must be held.
+func (s *InMemorySessionStore) unindex(userId string, sessionId string) {
+	if s.users[sessionId] == userId {
+		delete(s.users, sessionId)
+	}
+	sessions := s.index[userId]
+	delete(sessions, sessionId)
+	if len(sessions) == 0 {
+		delete(s.index, userId)
+	}
+}
+
+// nextVersion returns a new version. mutex must be held.
+func (s *InMemorySessionStore) nextVersion() uint64 {
+	s.version++
+	return s.version
+}
+
+// lookup returns the unexpired entry of key and marks it as recently used, removing it if expired. mutex must be held.
+func (s *InMemorySessionStore) lookup(key string) *memoryEntry {
+	e, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	if e.expired(time.Now()) {
+		s.expire(e)
+		return nil
+	}
+	s.lru.MoveToFront(e.element)
+	return e
+}
+
+// expire removes the expired entry, whose hooks are called by gc later, or by unlock once the store is closed. mutex
+// must be held.
+func (s *InMemorySessionStore) expire(e *memoryEntry) {
+	s.remove(e)
+	s.stats.Expirations++
+	s.expired = append(s.expired, e.key)
+	s.notifyGC()
+}
+
+// unlock releases mutex. Once the store is closed, gc doesn't run any more, so the hooks of the entries expired are
+// called here instead, after mutex is released.
+func (s *InMemorySessionStore) unlock() {
+	var expired []string
+	select {
+	case <-s.stop:
+		expired = s.expired
+		s.expired = nil
+	default:
+	}
+	s.mutex.Unlock()
+	for _, key := range expired {
+		s.hooks.fire(key)
+	}
+}
+
+// OnExpire registers hook called with the id of each session expired, from the goroutine removing expired sessions.
+// The sessions found past their absolute timeout by CreateSession trigger it as well. Hooks should be registered before
+// the store is used, e.g. before RestoreFile, so that no expiration is missed.
+func (s *InMemorySessionStore) OnExpire(hook ExpireHook) {
+	s.hooks.add(nil, hook)
+}
+
+func (s *InMemorySessionStore) addExpireHook(key interface{}, hook ExpireHook) {
+	s.hooks.add(key, hook)
+}
+
+func (s *InMemorySessionStore) notifyExpired(sessionId string) {
+	s.hooks.fire(sessionId)
+}
+
+// put adds or replaces the entry of key, evicting the least recently used entries if the store is full. mutex must be
+// held.
+func (s *InMemorySessionStore) put(key string, value string, version uint64, expiration time.Duration) {
+	var deadline time.Time
+	if expiration > 0 {
+		deadline = time.Now().Add(expiration)
+	}
+	s.putUntil(key, value, version, deadline)
+}
+
+// putUntil is put with the deadline of the entry, zero deadline means never expires. mutex must be held.
+func (s *InMemorySessionStore) putUntil(key string, value string, version uint64, deadline time.Time) {
+	e, ok := s.data[key]
+	if ok && e.expired(time.Now()) {
+		s.expire(e)
+		ok = false
+	}
+	if !ok {
+		e = &memoryEntry{key: key, index: -1}
+		e.element = s.lru.PushFront(e)
+		s.data[key] = e
+	} else {
+		s.lru.MoveToFront(e.element)
+	}
+	e.value = value
+	e.version = version
+	e.deadline = deadline
+	if deadline.IsZero() {
+		// never expires, no need to be tracked by gc
+		if e.index >= 0 {
+			heap.Remove(&s.expiry, e.index)
+		}
+	} else {
+		if e.index >= 0 {
+			heap.Fix(&s.expiry, e.index)
+		} else {
+			heap.Push(&s.expiry, e)
+		}
+		if e.index == 0 {
+			s.notifyGC()
+		}
+	}
+	for s.maxEntries > 0 && len(s.data) > s.maxEntries {
+		s.remove(s.lru.Back().Value.(*memoryEntry))
+		s.stats.Evictions++
+	}
+}
+
+// remove deletes the entry from data, expiry, lru and index. mutex must be held.
+func (s *InMemorySessionStore) remove(e *memoryEntry) {
+	delete(s.data, e.key)
+	if userId, ok := s.users[e.key]; ok {
+		s.unindex(userId, e.key)
+	}
+	if e.index >= 0 {
+		heap.Remove(&s.expiry, e.index)
+	}
+	s.lru.Remove(e.element)
+}
+
+// purge removes all the entries without calling the hooks.
+func (s *InMemorySessionStore) purge() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data = make(map[string]*memoryEntry)
+	s.expiry = nil
+	s.lru.Init()
+	s.index = make(map[string]map[string]SessionInfo)
+	s.users = make(map[string]string)
+}
+
+// notifyGC wakes gc up to recompute the time to sleep.
+func (s *InMemorySessionStore) notifyGC() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+type MemoryStoreOptions interface {
+	apply(*memoryStoreOptions)
+}
+
+// WithMaxEntries limits the number of sessions kept by InMemorySessionStore, evicting the least recently used ones
+// once exceeded. Non positive value means unlimited, which is the default.
+func WithMaxEntries(n int) MemoryStoreOptions {
+	return newFuncMemoryStoreOption(func(option *memoryStoreOptions) {
+		option.MaxEntries = n
+	})
+}
+
+// WithSnapshotFile writes the snapshot of the sessions to the file at path every interval and on Close, so that they
+// can be loaded by RestoreFile after restarting. Non positive interval means only on Close. The failures of periodic
+// snapshots are counted by MemoryStoreStats.SnapshotFailures and retried next time.
+func WithSnapshotFile(path string, interval time.Duration) MemoryStoreOptions {
+	return newFuncMemoryStoreOption(func(option *memoryStoreOptions) {
+		option.SnapshotPath = path
+		option.SnapshotInterval = interval
+	})
+}
+
+type memoryStoreOptions struct {
+	MaxEntries       int
+	SnapshotPath     string
+	SnapshotInterval time.Duration
+}
+
+type funcMemoryStoreOption struct {
+	f func(option *memoryStoreOptions)
+}
+
+func (f *funcMemoryStoreOption) apply(option *memoryStoreOptions) {
+	f.f(option)
+}
+
+func newFuncMemoryStoreOption(f func(option *memoryStoreOptions)) MemoryStoreOptions {
+	return &funcMemoryStoreOption{f: f}
+}
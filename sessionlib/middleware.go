@@ -0,0 +1,294 @@
+package sessionlib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Middleware returns a net/http middleware loading the session of each request with CreateSession. The session id is
+// read from and written to a cookie by default, or a header if WithHeader is specified. Handlers can get the session by
+// FromContext(r.Context()). Modified sessions are saved automatically right before the response headers are written,
+// so handlers don't need to call Save. The requests of unsafe methods are checked against CSRF if WithCSRFProtection
+// is specified.
+func Middleware(options ...MiddlewareOptions) func(http.Handler) http.Handler {
+	opt := &middlewareOptions{
+		Cookie: http.Cookie{
+			Name:     "SESSIONID",
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, ErrCSRFTokenInvalid) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		},
+		CSRFHeader:    "X-CSRF-Token",
+		CSRFFormField: "csrf_token",
+	}
+	for _, o := range options {
+		o.apply(opt)
+	}
+	// the store is resolved once instead of per request, so that redis clients are shared by requests
+	resolve := resolveOnce(opt.SessionOptions)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sessionOpts, err := resolve()
+			if err != nil {
+				opt.ErrorHandler(w, r, err)
+				return
+			}
+			sw := &sessionResponseWriter{ResponseWriter: w, request: r, options: opt}
+			s, err := CreateSession(func() string {
+				return opt.readId(r)
+			}, func(id string) {
+				sw.setId(id)
+			}, sessionOpts)
+			if err != nil {
+				opt.ErrorHandler(w, r, err)
+				return
+			}
+			if err := opt.checkCSRF(r, s); err != nil {
+				opt.ErrorHandler(w, r, err)
+				return
+			}
+			// the id set while creating the session is written only if the session gets stored
+			sw.fresh = sw.idSet
+			sw.session = s.(*session)
+			r = r.WithContext(NewContext(r.Context(), s))
+			sw.request = r
+			next.ServeHTTP(sw, r)
+			sw.commit()
+		})
+	}
+}
+
+// resolveOnce returns the function resolving the store specified by options on the first call, which returns options
+// with the store resolved.
+func resolveOnce(options []SessionOptions) func() ([]SessionOptions, error) {
+	var once sync.Once
+	var resolved []SessionOptions
+	var storeErr error
+	return func() ([]SessionOptions, error) {
+		once.Do(func() {
+			store, err := resolveStore(newSessionOptions(options))
+			if err != nil {
+				storeErr = err
+				return
+			}
+			resolved = append(append([]SessionOptions{}, options...), WithSessionStore(store))
+		})
+		return resolved, storeErr
+	}
+}
+
+// NewContext returns a copy of ctx carrying the session.
+func NewContext(ctx context.Context, s Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, s)
+}
+
+// FromContext returns the session carried by ctx, or nil if there is none.
+func FromContext(ctx context.Context) Session {
+	s, _ := ctx.Value(sessionContextKey{}).(Session)
+	return s
+}
+
+type sessionContextKey struct{}
+
+// ClientInfoFromRequest returns the client of the request for Session.BindUser. The IP is taken from r.RemoteAddr,
+// which should be rewritten by a trusted proxy middleware if the service is behind proxies.
+func ClientInfoFromRequest(r *http.Request) ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return ClientInfo{IP: ip, UserAgent: r.UserAgent()}
+}
+
+// sessionResponseWriter saves the session and writes the session id before the response headers are written.
+type sessionResponseWriter struct {
+	http.ResponseWriter
+	request *http.Request
+	options *middlewareOptions
+	session *session
+
+	id    string
+	idSet bool
+	// fresh is true if the session has been created by this request and the id has not been changed since then
+	fresh     bool
+	committed bool
+	failed    bool
+}
+
+func (w *sessionResponseWriter) WriteHeader(code int) {
+	if !w.commit() {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sessionResponseWriter) Write(b []byte) (int, error) {
+	if !w.commit() {
+		// the error response has been written, discard the body of the handler
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *sessionResponseWriter) Flush() {
+	if !w.commit() {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the original writer for http.ResponseController.
+func (w *sessionResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *sessionResponseWriter) setId(id string) {
+	w.id = id
+	w.idSet = true
+	w.fresh = false
+}
+
+// commit saves the modified session and writes the session id if needed, returning false if saving failed.
+func (w *sessionResponseWriter) commit() bool {
+	if w.committed {
+		return !w.failed
+	}
+	w.committed = true
+	if w.session == nil {
+		return true
+	}
+	w.session.mutex.RLock()
+	dirty := w.session.dirty
+	w.session.mutex.RUnlock()
+	if dirty {
+		if err := w.session.Save(w.request.Context()); err != nil {
+			w.failed = true
+			w.options.ErrorHandler(w.ResponseWriter, w.request, err)
+			return false
+		}
+	}
+	w.session.mutex.RLock()
+	persisted := w.session.persisted
+	w.session.mutex.RUnlock()
+	if w.idSet && (!w.fresh || persisted) {
+		w.options.writeId(w.ResponseWriter, w.id)
+	}
+	return true
+}
+
+type MiddlewareOptions interface {
+	apply(*middlewareOptions)
+}
+
+// WithCookie specifies the cookie carrying the session id. Value and Expires of cookie are ignored, and the other
+// fields such as Name, Path, Domain, Secure, HttpOnly, SameSite and MaxAge are used as the template of the cookie
+// written. By default, the cookie is called SESSIONID with path / and HttpOnly, SameSite=Lax set.
+func WithCookie(cookie http.Cookie) MiddlewareOptions {
+	return newFuncMiddlewareOption(func(option *middlewareOptions) {
+		option.Cookie = cookie
+	})
+}
+
+// WithHeader makes the session id carried by the header called name in both requests and responses instead of cookie.
+func WithHeader(name string) MiddlewareOptions {
+	return newFuncMiddlewareOption(func(option *middlewareOptions) {
+		option.Header = name
+	})
+}
+
+// WithSessionOptions specifies the options passed to CreateSession.
+func WithSessionOptions(options ...SessionOptions) MiddlewareOptions {
+	return newFuncMiddlewareOption(func(option *middlewareOptions) {
+		option.SessionOptions = append(option.SessionOptions, options...)
+	})
+}
+
+// WithErrorHandler specifies the handler called if the session fails to be loaded or saved. By default, 500 Internal
+// Server Error is responded. The response of the handler is discarded once the error handler is called.
+func WithErrorHandler(handler func(w http.ResponseWriter, r *http.Request, err error)) MiddlewareOptions {
+	return newFuncMiddlewareOption(func(option *middlewareOptions) {
+		option.ErrorHandler = handler
+	})
+}
+
+// WithCSRFProtection rejects the requests of unsafe methods, i.e. other than GET, HEAD, OPTIONS and TRACE, unless they
+// carry the token returned by Session.CSRFToken in the X-CSRF-Token header or the csrf_token form field, which can be
+// changed by WithCSRFTokenLookup. ErrCSRFTokenInvalid is passed to the error handler for the rejected requests, which
+// responds 403 Forbidden by default.
+func WithCSRFProtection() MiddlewareOptions {
+	return newFuncMiddlewareOption(func(option *middlewareOptions) {
+		option.CSRF = true
+	})
+}
+
+// WithCSRFTokenLookup specifies the header and the form field carrying the CSRF token, see WithCSRFProtection. The
+// form field is read only if the header is absent, and empty formField disables it.
+func WithCSRFTokenLookup(header string, formField string) MiddlewareOptions {
+	return newFuncMiddlewareOption(func(option *middlewareOptions) {
+		option.CSRFHeader = header
+		option.CSRFFormField = formField
+	})
+}
+
+type middlewareOptions struct {
+	Cookie         http.Cookie
+	Header         string
+	SessionOptions []SessionOptions
+	ErrorHandler   func(w http.ResponseWriter, r *http.Request, err error)
+
+	CSRF          bool
+	CSRFHeader    string
+	CSRFFormField string
+}
+
+func (o *middlewareOptions) readId(r *http.Request) string {
+	if o.Header != "" {
+		return r.Header.Get(o.Header)
+	}
+	c, err := r.Cookie(o.Cookie.Name)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// writeId writes the session id to the response, an empty id removes the cookie.
+func (o *middlewareOptions) writeId(w http.ResponseWriter, id string) {
+	if o.Header != "" {
+		w.Header().Set(o.Header, id)
+		return
+	}
+	c := o.Cookie
+	c.Value = id
+	c.Expires = time.Time{}
+	if id == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, &c)
+}
+
+type funcMiddlewareOption struct {
+	f func(option *middlewareOptions)
+}
+
+func (f *funcMiddlewareOption) apply(option *middlewareOptions) {
+	f.f(option)
+}
+
+func newFuncMiddlewareOption(f func(option *middlewareOptions)) MiddlewareOptions {
+	return &funcMiddlewareOption{f: f}
+}
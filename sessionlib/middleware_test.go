@@ -0,0 +1,147 @@
+package sessionlib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	store := NewInMemorySessionStore()
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	handler := Middleware(WithSessionOptions(WithSessionStore(store)))(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s := FromContext(r.Context())
+			if r.URL.Path == "/login" {
+				_ = s.Set("user", "alice")
+			}
+			v, _ := s.Get("user")
+			if v != nil {
+				_, _ = w.Write([]byte(v.(string)))
+			}
+		}))
+
+	// anonymous visits don't get a cookie
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("unexpected cookie: %v", rec.Result().Cookies())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "SESSIONID" || !cookies[0].HttpOnly {
+		t.Fatalf("unexpected cookies: %v", cookies)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Body.String() != "alice" {
+		t.Fatalf("session not saved, got %q", rec.Body.String())
+	}
+}
+
+func TestMiddlewareCSRF(t *testing.T) {
+	store := NewInMemorySessionStore()
+	defer store.Close()
+	handler := Middleware(WithSessionOptions(WithSessionStore(store)), WithCSRFProtection())(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s := FromContext(r.Context())
+			switch r.URL.Path {
+			case "/form":
+				token, err := s.CSRFToken()
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = w.Write([]byte(token))
+			case "/submit":
+				_ = s.AddFlash("saved")
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+			default:
+				_, _ = w.Write([]byte(strings.Join(s.Flashes(), ",")))
+			}
+		}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/form", nil))
+	cookie, token := rec.Result().Cookies()[0], rec.Body.String()
+	submit := func(header string, form string) int {
+		req := httptest.NewRequest(http.MethodPost, "/submit", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if header != "" {
+			req.Header.Set("X-CSRF-Token", header)
+		}
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := submit("", ""); code != http.StatusForbidden {
+		t.Fatalf("expected the request without token forbidden, got %d", code)
+	}
+	if code := submit(token+"x", ""); code != http.StatusForbidden {
+		t.Fatalf("expected the request with wrong token forbidden, got %d", code)
+	}
+	if code := submit("", "csrf_token="+token); code != http.StatusSeeOther {
+		t.Fatalf("expected the token in form accepted, got %d", code)
+	}
+	if code := submit(token, ""); code != http.StatusSeeOther {
+		t.Fatalf("expected the token in header accepted, got %d", code)
+	}
+
+	// the flashes are consumed once
+	for _, expected := range []string{"saved,saved", ""} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Body.String() != expected {
+			t.Fatalf("expected flashes %q, got %q", expected, rec.Body.String())
+		}
+	}
+
+	// sessions without token reject any token
+	s, err := CreateSession(func() string {
+		return ""
+	}, nil, []SessionOptions{WithSessionStore(store)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.VerifyCSRF("") || s.VerifyCSRF(token) {
+		t.Fatal("expected no token verified")
+	}
+
+	// the flashes are dropped and the token is rotated once the session is cleared
+	token, err = s.CSRFToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.AddFlash("hi")
+	if err := s.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.Clear()
+	if err := s.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s, err = CreateSession(s.SessionId, nil, []SessionOptions{WithSessionStore(store)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flashes := s.Flashes(); len(flashes) != 0 {
+		t.Fatalf("expected flashes cleared, got %v", flashes)
+	}
+	if s.VerifyCSRF(token) {
+		t.Fatal("expected the token cleared")
+	}
+	if next, err := s.CSRFToken(); err != nil || next == token {
+		t.Fatalf("expected a new token, got %v", err)
+	}
+}
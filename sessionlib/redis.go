@@ -2,60 +2,527 @@ package sessionlib
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/go-redis/redis/v8"
+	"strings"
+	"sync"
 	"time"
 )
 
-// InMemorySessionStore stores the session in redis.
+// RedisSessionStore stores the session in redis, which can be a single node, a cluster or a failover group managed by
+// sentinels.
 type RedisSessionStore struct {
-	client        *redis.Client
-	clusterClient *redis.ClusterClient
+	client    redis.UniversalClient
+	timeout   time.Duration
+	keyPrefix string
+	hooks     *expireHooks
 }
 
+// NewRedisSessionStore creates the store with the client specified by WithRedisClient, or the one created with
+// WithRedisOptions or WithRedisClusters, in that order of precedence. The client created is shared by the stores
+// created with the same options pointer or cluster addresses, so that a connection pool is not opened on every call.
+// Likewise, the store is shared by the calls with the same client, timeout and key prefix, so that the hooks
+// registered on it are kept.
 func NewRedisSessionStore(options *sessionOptions) (SessionStore, error) {
-	if len(options.RedisClusters) == 0 {
-		return nil, errors.New("redis cluster not found")
-	}
-	if len(options.RedisClusters) == 1 {
-		cli := redis.NewClient(&redis.Options{
-			Addr: options.RedisClusters[0],
-		})
-		return &RedisSessionStore{
-			client: cli,
-		}, nil
-	} else {
-		cli := redis.NewClusterClient(&redis.ClusterOptions{
-			Addrs: options.RedisClusters,
-		})
-		return &RedisSessionStore{
-			clusterClient: cli,
-		}, nil
+	client := options.RedisClient
+	if client == nil {
+		var err error
+		if client, err = sharedRedisClient(options); err != nil {
+			return nil, err
+		}
+	}
+	key := redisStoreKey{client: client, timeout: options.RedisTimeout, keyPrefix: options.RedisKeyPrefix}
+	shared, _ := sharedRedisStores.LoadOrStore(key, &RedisSessionStore{
+		client:    client,
+		timeout:   options.RedisTimeout,
+		keyPrefix: options.RedisKeyPrefix,
+		hooks:     &expireHooks{},
+	})
+	store := shared.(*RedisSessionStore)
+	if options.RedisHash {
+		return &RedisHashSessionStore{store: store}, nil
+	}
+	return store, nil
+}
+
+// sharedRedisStores are the stores created by NewRedisSessionStore, keyed by redisStoreKey.
+var sharedRedisStores sync.Map
+
+// redisStoreKey identifies the stores sharing the same sessions.
+type redisStoreKey struct {
+	client    redis.UniversalClient
+	timeout   time.Duration
+	keyPrefix string
+}
+
+// sharedRedisClients are the clients created by NewRedisSessionStore, keyed by the *redis.UniversalOptions specified by
+// WithRedisOptions, or the addresses specified by WithRedisClusters joined by commas.
+var sharedRedisClients sync.Map
+
+// sharedRedisClient returns the client created for the options, which is created on first use and shared by the whole
+// process like sharedMemoryStore.
+func sharedRedisClient(options *sessionOptions) (redis.UniversalClient, error) {
+	redisOptions := options.RedisOptions
+	var key interface{} = redisOptions
+	if redisOptions == nil {
+		if len(options.RedisClusters) == 0 {
+			return nil, errors.New("redis cluster not found")
+		}
+		key = strings.Join(options.RedisClusters, ",")
+		redisOptions = &redis.UniversalOptions{Addrs: options.RedisClusters}
+	}
+	if client, ok := sharedRedisClients.Load(key); ok {
+		return client.(redis.UniversalClient), nil
+	}
+	client := redis.NewUniversalClient(redisOptions)
+	if shared, loaded := sharedRedisClients.LoadOrStore(key, client); loaded {
+		// created by another goroutine in the meantime
+		_ = client.Close()
+		return shared.(redis.UniversalClient), nil
+	}
+	return client, nil
+}
+
+// NewRedisSessionStoreWithClient creates the store with an existing client, which is useful to share the client with
+// other components or to wrap the store. WithRedisTimeout and WithRedisKeyPrefix in options are applied.
+func NewRedisSessionStoreWithClient(client redis.UniversalClient, options ...SessionOptions) *RedisSessionStore {
+	opt := newSessionOptions(options)
+	return &RedisSessionStore{
+		client:    client,
+		timeout:   opt.RedisTimeout,
+		keyPrefix: opt.RedisKeyPrefix,
+		hooks:     &expireHooks{},
 	}
 }
 
+// key returns the redis key of the session.
+func (r *RedisSessionStore) key(key string) string {
+	return r.keyPrefix + key
+}
+
+// withTimeout limits each redis call to the timeout specified by WithRedisTimeout.
+func (r *RedisSessionStore) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, r.timeout)
+}
+
 func (r *RedisSessionStore) Get(ctx context.Context, key string) (string, error) {
-	if r.client != nil {
-		v, err := r.client.Get(ctx, key).Result()
-		return v, err
-	} else {
-		v, err := r.clusterClient.Get(ctx, key).Result()
-		return v, err
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	v, err := r.client.Get(ctx, r.key(key)).Result()
+	if err == redis.Nil {
+		return "", ErrSessionNotFound
 	}
+	return v, err
 }
 
 func (r *RedisSessionStore) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
-	if r.client != nil {
-		return r.client.Set(ctx, key, value, expiration).Err()
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.Set(ctx, r.key(key), value, expiration).Err()
+}
+
+func (r *RedisSessionStore) SetNX(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.SetNX(ctx, r.key(key), value, expiration).Result()
+}
+
+func (r *RedisSessionStore) Touch(ctx context.Context, key string, expiration time.Duration) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	key = r.key(key)
+	var ok bool
+	var err error
+	if expiration > 0 {
+		ok, err = r.client.PExpire(ctx, key, expiration).Result()
 	} else {
-		return r.clusterClient.Set(ctx, key, value, expiration).Err()
+		ok, err = r.client.Persist(ctx, key).Result()
 	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		n, err := r.client.Exists(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrSessionNotFound
+		}
+	}
+	return nil
 }
 
 func (r *RedisSessionStore) Delete(ctx context.Context, key string) error {
-	if r.client != nil {
-		return r.client.Del(ctx, key).Err()
-	} else {
-		return r.clusterClient.Del(ctx, key).Err()
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.client.Del(ctx, r.key(key)).Err()
+}
+
+// GetVersioned gets the value of key, whose version is the sha1 of the value, so that no extra key is needed.
+func (r *RedisSessionStore) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	v, err := r.Get(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+	return v, redisVersion(v), nil
+}
+
+// compareAndSetScript sets KEYS[1] to ARGV[2] with expiration ARGV[3] in milliseconds if the sha1 of its current value
+// is ARGV[1], or it doesn't exist if ARGV[1] is empty.
+var compareAndSetScript = redis.NewScript(`
+local current = redis.call('GET', KEYS[1])
+if ARGV[1] == '' then
+	if current then
+		return 0
+	end
+elseif (not current) or redis.sha1hex(current) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+func (r *RedisSessionStore) CompareAndSet(ctx context.Context, key string, value string, version string,
+	expiration time.Duration) (string, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	var px int64
+	if expiration > 0 {
+		// round up so that the sub millisecond expiration doesn't mean never expires
+		px = int64((expiration + time.Millisecond - 1) / time.Millisecond)
+	}
+	ok, err := compareAndSetScript.Run(ctx, r.client, []string{r.key(key)}, version, value, px).Int()
+	if err != nil {
+		return "", err
+	}
+	if ok == 0 {
+		return "", ErrSessionConflict
 	}
+	return redisVersion(value), nil
+}
+
+func redisVersion(value string) string {
+	sum := sha1.Sum([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// userKey is the set of the sessions of the user, and infoKey is the SessionInfo of a session in json, which expires
+// together with the session.
+func (r *RedisSessionStore) userKey(userId string) string {
+	return r.key("user:" + userId)
 }
+
+func (r *RedisSessionStore) infoKey(sessionId string) string {
+	return r.key("info:" + sessionId)
+}
+
+func (r *RedisSessionStore) IndexSession(ctx context.Context, info SessionInfo) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	userKey := r.userKey(info.UserId)
+	pipe := r.client.Pipeline()
+	sessionTTL := pipe.PTTL(ctx, r.key(info.SessionId))
+	userTTL := pipe.PTTL(ctx, userKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	// PTTL returns -2 if the key doesn't exist, and -1 if it never expires
+	if sessionTTL.Val() == -2 {
+		return ErrSessionNotFound
+	}
+	var expiration time.Duration
+	if sessionTTL.Val() > 0 {
+		expiration = sessionTTL.Val()
+	}
+	pipe = r.client.Pipeline()
+	pipe.SAdd(ctx, userKey, info.SessionId)
+	pipe.Set(ctx, r.infoKey(info.SessionId), data, expiration)
+	// the set lives as long as the last session of the user
+	if expiration <= 0 {
+		pipe.Persist(ctx, userKey)
+	} else if ttl := userTTL.Val(); ttl != -1 && ttl < expiration {
+		pipe.PExpire(ctx, userKey, expiration)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisSessionStore) UnindexSession(ctx context.Context, userId string, sessionId string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	pipe := r.client.Pipeline()
+	pipe.SRem(ctx, r.userKey(userId), sessionId)
+	pipe.Del(ctx, r.infoKey(sessionId))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (r *RedisSessionStore) ListSessions(ctx context.Context, userId string) ([]SessionInfo, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	sids, err := r.client.SMembers(ctx, r.userKey(userId)).Result()
+	if err != nil || len(sids) == 0 {
+		return nil, err
+	}
+	pipe := r.client.Pipeline()
+	exists := make([]*redis.IntCmd, len(sids))
+	infos := make([]*redis.StringCmd, len(sids))
+	for i, sid := range sids {
+		exists[i] = pipe.Exists(ctx, r.key(sid))
+		infos[i] = pipe.Get(ctx, r.infoKey(sid))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	var result []SessionInfo
+	var stale []interface{}
+	for i, sid := range sids {
+		var info SessionInfo
+		if exists[i].Val() == 0 || infos[i].Err() != nil || json.Unmarshal([]byte(infos[i].Val()), &info) != nil {
+			stale = append(stale, sid)
+			continue
+		}
+		result = append(result, info)
+	}
+	if len(stale) > 0 {
+		// the sessions expired are removed from the set lazily
+		if err := r.client.SRem(ctx, r.userKey(userId), stale...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (r *RedisSessionStore) RevokeAll(ctx context.Context, userId string) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	sids, err := r.client.SMembers(ctx, r.userKey(userId)).Result()
+	if err != nil || len(sids) == 0 {
+		return err
+	}
+	pipe := r.client.Pipeline()
+	for _, sid := range sids {
+		pipe.Del(ctx, r.key(sid))
+		pipe.Del(ctx, r.infoKey(sid))
+	}
+	pipe.SRem(ctx, r.userKey(userId), stringsToInterfaces(sids)...)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func stringsToInterfaces(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, v := range values {
+		result[i] = v
+	}
+	return result
+}
+
+// ListenExpiry subscribes to the keyspace notifications of expired keys and calls the hooks registered by
+// OnExpire, blocking until ctx is done. Redis must be configured with notify-keyspace-events containing "Ex", and
+// the sessions should be distinguished from other data by WithRedisKeyPrefix. Since the notifications are local to
+// each node, only the expiration on the node subscribed is received in cluster mode.
+func (r *RedisSessionStore) ListenExpiry(ctx context.Context) error {
+	pubsub := r.client.PSubscribe(ctx, "__keyevent@*__:expired")
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return fmt.Errorf("fail to subscribe expiry notifications: %w", err)
+	}
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if sid, ok := r.sessionId(msg.Payload); ok {
+				r.hooks.fire(sid)
+			}
+		}
+	}
+}
+
+// sessionId returns the session id of the redis key, or false if the key is not a session.
+func (r *RedisSessionStore) sessionId(key string) (string, bool) {
+	if !strings.HasPrefix(key, r.keyPrefix) {
+		return "", false
+	}
+	sid := key[len(r.keyPrefix):]
+	if strings.HasPrefix(sid, "user:") || strings.HasPrefix(sid, "info:") {
+		// keys of the session index
+		return "", false
+	}
+	return sid, true
+}
+
+// OnExpire registers hook called with the id of each session expired, which is notified by ListenExpiry. The sessions
+// found past their absolute timeout by CreateSession trigger it as well.
+func (r *RedisSessionStore) OnExpire(hook ExpireHook) {
+	r.hooks.add(nil, hook)
+}
+
+func (r *RedisSessionStore) addExpireHook(key interface{}, hook ExpireHook) {
+	r.hooks.add(key, hook)
+}
+
+func (r *RedisSessionStore) notifyExpired(sessionId string) {
+	r.hooks.fire(sessionId)
+}
+
+// RedisHashSessionStore keeps each session as a redis hash whose fields are the values of the session, so that only
+// the values changed are written when the session is saved, which suits large sessions. Being a FieldSessionStore, it
+// can't be read or written as a whole by Get, Set and SetNX.
+type RedisHashSessionStore struct {
+	store *RedisSessionStore
+}
+
+// NewRedisHashSessionStoreWithClient creates the store with an existing client. WithRedisTimeout and
+// WithRedisKeyPrefix in options are applied.
+func NewRedisHashSessionStoreWithClient(client redis.UniversalClient, options ...SessionOptions) *RedisHashSessionStore {
+	return &RedisHashSessionStore{store: NewRedisSessionStoreWithClient(client, options...)}
+}
+
+func (r *RedisHashSessionStore) Get(ctx context.Context, key string) (string, error) {
+	return "", errRedisHashWhole
+}
+
+func (r *RedisHashSessionStore) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	return errRedisHashWhole
+}
+
+func (r *RedisHashSessionStore) SetNX(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	return false, errRedisHashWhole
+}
+
+func (r *RedisHashSessionStore) Touch(ctx context.Context, key string, expiration time.Duration) error {
+	return r.store.Touch(ctx, key, expiration)
+}
+
+func (r *RedisHashSessionStore) Delete(ctx context.Context, key string) error {
+	return r.store.Delete(ctx, key)
+}
+
+func (r *RedisHashSessionStore) IndexSession(ctx context.Context, info SessionInfo) error {
+	return r.store.IndexSession(ctx, info)
+}
+
+func (r *RedisHashSessionStore) UnindexSession(ctx context.Context, userId string, sessionId string) error {
+	return r.store.UnindexSession(ctx, userId, sessionId)
+}
+
+func (r *RedisHashSessionStore) ListSessions(ctx context.Context, userId string) ([]SessionInfo, error) {
+	return r.store.ListSessions(ctx, userId)
+}
+
+func (r *RedisHashSessionStore) RevokeAll(ctx context.Context, userId string) error {
+	return r.store.RevokeAll(ctx, userId)
+}
+
+// ListenExpiry works like RedisSessionStore.ListenExpiry.
+func (r *RedisHashSessionStore) ListenExpiry(ctx context.Context) error {
+	return r.store.ListenExpiry(ctx)
+}
+
+// OnExpire works like RedisSessionStore.OnExpire.
+func (r *RedisHashSessionStore) OnExpire(hook ExpireHook) {
+	r.store.OnExpire(hook)
+}
+
+func (r *RedisHashSessionStore) addExpireHook(key interface{}, hook ExpireHook) {
+	r.store.addExpireHook(key, hook)
+}
+
+func (r *RedisHashSessionStore) notifyExpired(sessionId string) {
+	r.store.notifyExpired(sessionId)
+}
+
+func (r *RedisHashSessionStore) GetFields(ctx context.Context, key string) (map[string][]byte, error) {
+	ctx, cancel := r.store.withTimeout(ctx)
+	defer cancel()
+	fields, err := r.store.client.HGetAll(ctx, r.store.key(key)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	values := make(map[string][]byte, len(fields))
+	for k, v := range fields {
+		values[k] = []byte(v)
+	}
+	return values, nil
+}
+
+// updateFieldsScript updates the hash KEYS[1]. ARGV[1] is 1 to replace the hash, otherwise the hash must exist.
+// ARGV[2] is the expiration in milliseconds, ARGV[3] is the number of fields to delete, which are followed by the
+// fields to delete and then the field-value pairs to set.
+var updateFieldsScript = redis.NewScript(`
+if ARGV[1] == '1' then
+	redis.call('DEL', KEYS[1])
+elseif redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local n = tonumber(ARGV[3])
+if n > 0 then
+	redis.call('HDEL', KEYS[1], unpack(ARGV, 4, 3 + n))
+end
+if #ARGV > 3 + n then
+	redis.call('HSET', KEYS[1], unpack(ARGV, 4 + n, #ARGV))
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+else
+	redis.call('PERSIST', KEYS[1])
+end
+return 1
+`)
+
+func (r *RedisHashSessionStore) UpdateFields(ctx context.Context, key string, set map[string][]byte, deleted []string,
+	replace bool, expiration time.Duration) error {
+	ctx, cancel := r.store.withTimeout(ctx)
+	defer cancel()
+	var px int64
+	if expiration > 0 {
+		px = int64((expiration + time.Millisecond - 1) / time.Millisecond)
+	}
+	replaceArg := 0
+	if replace {
+		replaceArg = 1
+	}
+	args := make([]interface{}, 0, 3+len(deleted)+2*len(set))
+	args = append(args, replaceArg, px, len(deleted))
+	for _, k := range deleted {
+		args = append(args, k)
+	}
+	for k, v := range set {
+		args = append(args, k, v)
+	}
+	ok, err := updateFieldsScript.Run(ctx, r.store.client, []string{r.store.key(key)}, args...).Int()
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrSessionConflict
+	}
+	return nil
+}
+
+var errRedisHashWhole = errors.New("redis hash store can't be accessed as a whole, use GetFields and UpdateFields instead")
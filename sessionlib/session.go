@@ -2,11 +2,10 @@ package sessionlib
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
-	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,100 +19,680 @@ type SessionIdSetter func(string)
 // CreateSession gets the session store associated with sessionId which can be extracted by SessionIdGetter.
 // If the session doesn't exist, create a new one and set the sessionId with SessionIdSetter.
 // You can specify the store strategy by specify session options. By default, if WithRedisClusters option specifies
-// the redis cluster, RedisSessionStore is used to store the session. Otherwise, InMemorySessionStore is used.
+// the redis cluster, RedisSessionStore is used to store the session. Otherwise, an InMemorySessionStore shared by the
+// process is used.
 // You can implement your custom store strategy and specify it by WithSessionStore options.
 //
+// If the store fails, the error is returned rather than creating a new session, unless WithFallbackOnStoreError is
+// specified.
+//
 // sessionIdGetter may not be nil, while sessionIdSetter can be.
 func CreateSession(sessionIdGetter SessionIdGetter, sessionIdSetter SessionIdSetter, options []SessionOptions) (Session, error) {
 	if sessionIdGetter == nil {
 		return nil, errors.New("invalid session id getter")
 	}
-	opt := &sessionOptions{RedisClusters: nil, Expiration: 24 * time.Hour, RedisTimeout: 5 * time.Second}
-	for _, o := range options {
-		o.apply(opt)
-	}
-	var strategy SessionStore = nil
-	if opt.Store != nil {
-		strategy = opt.Store
-	} else if len(opt.RedisClusters) != 0 {
-		_strategy, err := NewRedisSessionStore(opt)
-		if err != nil {
-			return nil, err
-		}
-		strategy = _strategy
-	} else {
-		strategy = NewInMemorySessionStore()
+	opt := newSessionOptions(options)
+	strategy, err := resolveStore(opt)
+	if err != nil {
+		return nil, err
 	}
+	registerExpireHooks(strategy, opt.Hooks.OnExpire)
 
 	sid := sessionIdGetter()
-	v, err := strategy.Get(context.Background(), sid)
-	if err == nil {
-		var vv map[string]string
-		if err := json.Unmarshal([]byte(v), &vv); err != nil {
+	ctx := context.Background()
+	if validSessionId(strategy, opt.IdGenerator, sid) {
+		vv, version, err := getSession(ctx, strategy, sid, opt.Codec)
+		if err == nil {
+			var s *session
+			s, err = loadSession(ctx, strategy, sid, vv, version, opt)
+			if err == nil && s != nil {
+				s.idSetter = sessionIdSetter
+				return s, nil
+			}
+		}
+		if err != nil && !errors.Is(err, ErrSessionNotFound) && !opt.FallbackOnStoreError {
 			return nil, err
 		}
-		return &session{storeStrategy: strategy, sid: sid, expiration: opt.Expiration, values: vv}, nil
 	}
-	sid = newUUID()
+	sid, err = opt.IdGenerator.Generate()
+	if err != nil {
+		return nil, err
+	}
 	if sessionIdSetter != nil {
 		sessionIdSetter(sid)
 	}
+	s, err := newSession(strategy, sid, opt)
+	if err != nil {
+		return nil, err
+	}
+	s.idSetter = sessionIdSetter
+	return s, nil
+}
+
+// validSessionId returns whether the session of sid should be looked up in the store. The ids of token stores are
+// verified by the stores themselves.
+func validSessionId(strategy SessionStore, generator SessionIdGenerator, sid string) bool {
+	if sid == "" {
+		return false
+	}
+	if _, ok := strategy.(tokenStore); ok {
+		return true
+	}
+	return generator.Validate(sid)
+}
+
+func newSession(strategy SessionStore, sid string, opt *sessionOptions) (*session, error) {
+	s := &session{
+		storeStrategy:   strategy,
+		sid:             sid,
+		values:          make(map[string][]byte),
+		cache:           make(map[string]interface{}),
+		codec:           opt.Codec,
+		idGenerator:     opt.IdGenerator,
+		expiration:      opt.Expiration,
+		idleTimeout:     opt.IdleTimeout,
+		absoluteTimeout: opt.AbsoluteTimeout,
+		conflictPolicy:  opt.ConflictPolicy,
+		changed:         make(map[string]struct{}),
+		deleted:         make(map[string]struct{}),
+		hooks:           opt.Hooks,
+	}
+	if err := s.stampCreatedAt(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// getSession gets the values of the session from the store, together with its version if the store is a
+// VersionedSessionStore.
+func getSession(ctx context.Context, strategy SessionStore, sid string, codec Codec) (map[string][]byte, string, error) {
+	if fs, ok := strategy.(FieldSessionStore); ok {
+		vv, err := fs.GetFields(ctx, sid)
+		return vv, "", err
+	}
+	var v, version string
+	var err error
+	if vs, ok := strategy.(VersionedSessionStore); ok {
+		v, version, err = vs.GetVersioned(ctx, sid)
+	} else {
+		v, err = strategy.Get(ctx, sid)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	vv, err := codec.UnmarshalValues([]byte(v))
+	if err != nil {
+		return nil, "", fmt.Errorf("fail to decode session: %w", err)
+	}
+	return vv, version, nil
+}
 
-	return &session{
-		storeStrategy: strategy,
-		sid:           sid,
-		values:        make(map[string]string),
-		expiration:    opt.Expiration,
-	}, nil
+// loadSession decodes the session loaded from the store and enforces the timeouts, returning nil if the session has
+// passed its absolute timeout.
+func loadSession(ctx context.Context, strategy SessionStore, sid string, vv map[string][]byte, version string,
+	opt *sessionOptions) (*session, error) {
+	s := &session{
+		storeStrategy:   strategy,
+		sid:             sid,
+		expiration:      opt.Expiration,
+		idleTimeout:     opt.IdleTimeout,
+		absoluteTimeout: opt.AbsoluteTimeout,
+		codec:           opt.Codec,
+		idGenerator:     opt.IdGenerator,
+		values:          vv,
+		cache:           make(map[string]interface{}),
+		persisted:       true,
+		version:         version,
+		conflictPolicy:  opt.ConflictPolicy,
+		changed:         make(map[string]struct{}),
+		deleted:         make(map[string]struct{}),
+		hooks:           opt.Hooks,
+	}
+	var createdAt int64
+	if raw, ok := vv[createdAtKey]; ok && s.codec.Unmarshal(raw, &createdAt) == nil {
+		s.createdAt = time.UnixMilli(createdAt)
+	} else if err := s.stampCreatedAt(time.Now()); err != nil {
+		// saved by previous versions, the absolute timeout counts from now on
+		return nil, err
+	}
+	if s.absoluteTimeout > 0 && !time.Now().Before(s.createdAt.Add(s.absoluteTimeout)) {
+		if err := strategy.Delete(ctx, sid); err != nil {
+			return nil, err
+		}
+		if notifier, ok := strategy.(expiryNotifier); ok {
+			notifier.notifyExpired(sid)
+		}
+		return nil, nil
+	}
+	if s.idleTimeout > 0 {
+		if _, ok := strategy.(tokenStore); ok {
+			// the expiration is sealed in the token, which slides once the session is saved
+			s.dirty = true
+		} else if err := strategy.Touch(ctx, sid, s.ttl()); err != nil {
+			return nil, err
+		}
+	}
+	if index, ok := strategy.(SessionIndex); ok {
+		if info, ok := s.info(); ok {
+			// only the last seen time is refreshed, which is not worth failing the request
+			_ = index.IndexSession(ctx, info)
+		}
+	}
+	return s, nil
 }
 
 // Session represents session which can get and put data into. You can call Get and Set any times but nothing would be store
 // until Save is called.
 type Session interface {
-	// Get by key, returning the value and whether the key exists.
+	// Get by key, returning the value and whether the key exists. The values loaded from the store are decoded into
+	// their generic form, e.g. map[string]interface{} for the structs encoded by JSONCodec, use GetAs to decode them
+	// into specified types.
 	Get(key string) (interface{}, bool)
 
-	// Set key-value pair
-	Set(key, value string) error
+	// Set key-value pair. The value is encoded by the codec specified by WithCodec.
+	Set(key string, value interface{}) error
+
+	// Delete deletes the key. If key doesn't exist, do nothing.
+	Delete(key string)
+
+	// Clear deletes all the keys, including the flash messages, the CSRF token, which is generated again by CSRFToken,
+	// and the user bound by BindUser, whose association with the session is removed from the SessionIndex once the
+	// session is saved.
+	Clear()
 
 	// Save saves all the key-value pairs set before
 	Save(ctx context.Context) error
 
+	// Destroy removes the session from the store and clears its values, which is typically called on logout.
+	// SessionIdSetter is called with an empty string to clear the session id. The session can't be saved any more.
+	Destroy(ctx context.Context) error
+
+	// RegenerateId moves the session to a new id and calls SessionIdSetter with it, which should be called after login
+	// to prevent session fixation. If the session has been stored, it's saved under the new id immediately and removed
+	// from the old one.
+	RegenerateId(ctx context.Context) error
+
+	// BindUser associates the session with the user on login, so that the session can be found by
+	// SessionIndex.ListSessions and revoked by SessionIndex.RevokeAll. client is the optional metadata listed together
+	// with the session. The session is saved immediately. ErrIndexNotSupported is returned if the store doesn't
+	// implement SessionIndex.
+	BindUser(ctx context.Context, userId string, client ClientInfo) error
+
+	// UserId returns the user bound by BindUser, or empty string if not bound.
+	UserId() string
+
+	// AddFlash adds a one-shot message, e.g. shown by the page redirected to, which is returned by Flashes only once.
+	AddFlash(message string) error
+
+	// Flashes returns the messages added by AddFlash and removes them, which takes effect once the session is saved.
+	Flashes() []string
+
+	// CSRFToken returns the CSRF token of the session, generating one if there is none. The session must be saved to
+	// keep the token generated, which is done automatically by Middleware.
+	CSRFToken() (string, error)
+
+	// VerifyCSRF returns whether token equals the CSRF token of the session, comparing in constant time.
+	VerifyCSRF(token string) bool
+
 	// get session id
 	SessionId() string
 }
 
+// ClientInfo is the client of a session, see ClientInfoFromRequest.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
 type session struct {
-	mutex         sync.RWMutex
-	sid           string
-	values        map[string]string
-	expiration    time.Duration
-	storeStrategy SessionStore
+	mutex sync.RWMutex
+	sid   string
+	// idSetter may be nil
+	idSetter SessionIdSetter
+	// values holds the encoded values
+	values map[string][]byte
+	// cache holds the values set or decoded before
+	cache       map[string]interface{}
+	codec       Codec
+	idGenerator SessionIdGenerator
+	expiration  time.Duration
+	// idleTimeout and absoluteTimeout are optional
+	idleTimeout     time.Duration
+	absoluteTimeout time.Duration
+	createdAt       time.Time
+	storeStrategy   SessionStore
+	// dirty is true if values have been changed since loaded or saved
+	dirty bool
+	// persisted is true if the session exists in the store
+	persisted bool
+	destroyed bool
+	// version is the version of the session in a VersionedSessionStore when it's loaded or saved, empty if the session
+	// is new
+	version        string
+	conflictPolicy ConflictPolicy
+	// changed and deleted are the keys changed since loaded or saved, which are applied to the latest values when the
+	// session is merged
+	changed map[string]struct{}
+	deleted map[string]struct{}
+	hooks   sessionHooks
+	// unbound is the user cleared by Clear, which is unindexed once the session is saved
+	unbound string
 }
 
 func (s *session) Get(key string) (interface{}, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v, ok := s.cache[key]; ok {
+		return v, true
+	}
+	raw, ok := s.values[key]
+	if !ok {
+		return nil, false
+	}
+	var v interface{}
+	if err := s.codec.Unmarshal(raw, &v); err != nil {
+		return nil, false
+	}
+	s.cache[key] = v
+	return v, true
+}
+
+func (s *session) decode(key string, v interface{}) (bool, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
-	v, ok := s.values[key]
-	return v, ok
+	raw, ok := s.values[key]
+	if !ok {
+		return false, nil
+	}
+	if cached, ok := s.cache[key]; ok && assign(v, cached) == nil {
+		return true, nil
+	}
+	return true, s.codec.Unmarshal(raw, v)
 }
 
-func (s *session) Set(key, value string) error {
+func (s *session) Set(key string, value interface{}) error {
+	raw, err := s.codec.Marshal(value)
+	if err != nil {
+		return err
+	}
 	s.mutex.Lock()
-	s.mutex.Unlock()
-	s.values[key] = value
+	defer s.mutex.Unlock()
+	s.values[key] = raw
+	s.cache[key] = value
+	s.track(key, false)
 	return nil
 }
 
+func (s *session) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.values[key]; ok {
+		delete(s.values, key)
+		delete(s.cache, key)
+		s.track(key, true)
+	}
+}
+
+func (s *session) Clear() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if userId := s.reserved(userIdKey); userId != "" {
+		s.unbound = userId
+	}
+	for k := range s.values {
+		if strings.HasPrefix(k, reservedKeyPrefix) && !clearedReservedKeys[k] {
+			continue
+		}
+		delete(s.values, k)
+		delete(s.cache, k)
+		s.track(k, true)
+	}
+}
+
+// track records the key changed or deleted. mutex must be held.
+func (s *session) track(key string, deleted bool) {
+	if deleted {
+		s.deleted[key] = struct{}{}
+		delete(s.changed, key)
+	} else {
+		s.changed[key] = struct{}{}
+		delete(s.deleted, key)
+	}
+	s.dirty = true
+}
+
 func (s *session) Save(ctx context.Context) error {
-	vv, err := json.Marshal(s.values)
+	s.mutex.Lock()
+	if s.destroyed {
+		s.mutex.Unlock()
+		return ErrSessionDestroyed
+	}
+	if !s.dirty && s.persisted {
+		// nothing changed since loaded or saved
+		s.mutex.Unlock()
+		return nil
+	}
+	oldId, created := s.sid, !s.persisted
+	err := s.save(ctx, created)
+	if err == nil {
+		err = s.unindexCleared(ctx, s.sid)
+	}
+	sid := s.sid
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	// the id of the sessions kept by token stores changes on each save
+	if sid != oldId && s.idSetter != nil {
+		s.idSetter(sid)
+	}
+	s.fireSaved(ctx, created)
+	return nil
+}
+
+// fireSaved calls the hooks after the session is saved, created is true if it's saved for the first time. mutex must
+// not be held, so that the hooks can access the session.
+func (s *session) fireSaved(ctx context.Context, created bool) {
+	if created {
+		fireSessionHooks(ctx, s.hooks.OnCreate, s)
+	}
+	fireSessionHooks(ctx, s.hooks.OnSave, s)
+}
+
+// save writes the values to the store under the current id, or replaces the id by the sealed values for token
+// stores. FieldSessionStore only gets the values changed since loaded or saved unless full is true. mutex must be held.
+func (s *session) save(ctx context.Context, full bool) error {
+	if fs, ok := s.storeStrategy.(FieldSessionStore); ok {
+		if err := s.updateFields(ctx, fs, full); err != nil {
+			return err
+		}
+	} else if err := s.saveValues(ctx); err != nil {
+		return err
+	}
+	s.dirty = false
+	s.persisted = true
+	s.changed = make(map[string]struct{})
+	s.deleted = make(map[string]struct{})
+	return nil
+}
+
+// unindexCleared removes the association of the session indexed under sid with the user cleared by Clear. mutex must
+// be held.
+func (s *session) unindexCleared(ctx context.Context, sid string) error {
+	if s.unbound == "" {
+		return nil
+	}
+	userId := s.unbound
+	s.unbound = ""
+	if index, ok := s.storeStrategy.(SessionIndex); ok {
+		return index.UnindexSession(ctx, userId, sid)
+	}
+	return nil
+}
+
+// saveValues writes all the values as a whole. mutex must be held.
+func (s *session) saveValues(ctx context.Context) error {
+	vv, err := s.codec.MarshalValues(s.values)
+	if err != nil {
+		return err
+	}
+	if ts, ok := s.storeStrategy.(tokenStore); ok {
+		token, err := ts.Seal(string(vv), s.ttl())
+		if err != nil {
+			return err
+		}
+		s.sid = token
+		return nil
+	}
+	if vs, ok := s.storeStrategy.(VersionedSessionStore); ok {
+		return s.compareAndSet(ctx, vs, vv)
+	}
+	return s.storeStrategy.Set(ctx, s.sid, string(vv), s.ttl())
+}
+
+// updateFields writes the values changed and deletes the ones deleted, or replaces the session with all the values
+// if full is true. mutex must be held.
+func (s *session) updateFields(ctx context.Context, store FieldSessionStore, full bool) error {
+	set := s.values
+	var deleted []string
+	if !full {
+		set = make(map[string][]byte, len(s.changed))
+		for k := range s.changed {
+			set[k] = s.values[k]
+		}
+		deleted = make([]string, 0, len(s.deleted))
+		for k := range s.deleted {
+			deleted = append(deleted, k)
+		}
+	}
+	return store.UpdateFields(ctx, s.sid, set, deleted, full, s.ttl())
+}
+
+// maxMergeAttempts limits the times of merging in case the session keeps being saved by others.
+const maxMergeAttempts = 5
+
+// compareAndSet saves data only if the session hasn't been saved by others since loaded. On conflict, the changes are
+// applied to the latest values and saved again if ConflictMerge is specified. mutex must be held.
+func (s *session) compareAndSet(ctx context.Context, store VersionedSessionStore, data []byte) error {
+	for attempt := 0; ; attempt++ {
+		version, err := store.CompareAndSet(ctx, s.sid, string(data), s.version, s.ttl())
+		if err == nil {
+			s.version = version
+			return nil
+		}
+		if !errors.Is(err, ErrSessionConflict) || s.conflictPolicy != ConflictMerge || s.version == "" ||
+			attempt >= maxMergeAttempts {
+			return err
+		}
+		latest, version, err := store.GetVersioned(ctx, s.sid)
+		if errors.Is(err, ErrSessionNotFound) {
+			// destroyed or expired in the meantime, which must not be brought back
+			return ErrSessionConflict
+		}
+		if err != nil {
+			return err
+		}
+		values, err := s.codec.UnmarshalValues([]byte(latest))
+		if err != nil {
+			return fmt.Errorf("fail to decode session: %w", err)
+		}
+		for k := range s.deleted {
+			delete(values, k)
+		}
+		for k := range s.changed {
+			values[k] = s.values[k]
+		}
+		// the values changed by others are decoded again when accessed
+		for k := range s.cache {
+			if _, ok := s.changed[k]; !ok {
+				delete(s.cache, k)
+			}
+		}
+		s.values = values
+		s.version = version
+		if data, err = s.codec.MarshalValues(values); err != nil {
+			return err
+		}
+	}
+}
+
+// ttl returns the expiration of the session in the store from now on, which is the idle timeout if specified, and
+// doesn't go beyond the absolute timeout.
+func (s *session) ttl() time.Duration {
+	ttl := s.expiration
+	if s.idleTimeout > 0 {
+		ttl = s.idleTimeout
+	}
+	if s.absoluteTimeout > 0 {
+		if remaining := time.Until(s.createdAt.Add(s.absoluteTimeout)); ttl <= 0 || remaining < ttl {
+			ttl = remaining
+		}
+		if ttl <= 0 {
+			// expires right now
+			ttl = time.Millisecond
+		}
+	}
+	return ttl
+}
+
+// stampCreatedAt records the creation time in the session metadata.
+func (s *session) stampCreatedAt(t time.Time) error {
+	raw, err := s.codec.Marshal(t.UnixMilli())
+	if err != nil {
+		return err
+	}
+	s.createdAt = t
+	s.values[createdAtKey] = raw
+	return nil
+}
+
+func (s *session) Destroy(ctx context.Context) error {
+	s.mutex.Lock()
+	if err := s.storeStrategy.Delete(ctx, s.sid); err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	var err error
+	if index, ok := s.storeStrategy.(SessionIndex); ok {
+		if info, ok := s.info(); ok {
+			err = index.UnindexSession(ctx, info.UserId, info.SessionId)
+		}
+	}
+	err = errors.Join(err, s.unindexCleared(ctx, s.sid))
+	s.values = make(map[string][]byte)
+	s.cache = make(map[string]interface{})
+	s.dirty = false
+	s.persisted = false
+	s.destroyed = true
+	s.mutex.Unlock()
+	if s.idSetter != nil {
+		s.idSetter("")
+	}
+	fireSessionHooks(ctx, s.hooks.OnDestroy, s)
+	return err
+}
+
+func (s *session) RegenerateId(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.destroyed {
+		s.mutex.Unlock()
+		return ErrSessionDestroyed
+	}
+	sid, err := s.idGenerator.Generate()
 	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	oldId, oldVersion := s.sid, s.version
+	s.sid = sid
+	// the session is new under the new id
+	s.version = ""
+	saved := s.persisted
+	if s.persisted {
+		if err := s.save(ctx, true); err != nil {
+			s.sid = oldId
+			s.version = oldVersion
+			s.mutex.Unlock()
+			return err
+		}
+		// the session lives under the new id from now on even if the old one fails to be removed
+		err = errors.Join(s.storeStrategy.Delete(ctx, oldId), s.unindexCleared(ctx, oldId))
+		if index, ok := s.storeStrategy.(SessionIndex); ok {
+			if info, ok := s.info(); ok {
+				err = errors.Join(err, index.IndexSession(ctx, info), index.UnindexSession(ctx, info.UserId, oldId))
+			}
+		}
+	}
+	sid = s.sid
+	s.mutex.Unlock()
+	if s.idSetter != nil {
+		s.idSetter(sid)
+	}
+	if saved {
+		s.fireSaved(ctx, false)
+	}
+	return err
+}
+
+func (s *session) BindUser(ctx context.Context, userId string, client ClientInfo) error {
+	index, ok := s.storeStrategy.(SessionIndex)
+	if !ok {
+		return ErrIndexNotSupported
+	}
+	saved, created := false, false
+	defer func() {
+		// called after the mutex is released
+		if saved {
+			s.fireSaved(ctx, created)
+		}
+	}()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.destroyed {
+		return ErrSessionDestroyed
+	}
+	oldUserId := s.reserved(userIdKey)
+	for key, v := range map[string]string{userIdKey: userId, clientIPKey: client.IP, userAgentKey: client.UserAgent} {
+		raw, err := s.codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		s.values[key] = raw
+		delete(s.cache, key)
+		s.track(key, false)
+	}
+	created = !s.persisted
+	if err := s.save(ctx, created); err != nil {
 		return err
 	}
-	return s.storeStrategy.Set(ctx, s.sid, string(vv), s.expiration)
+	saved = true
+	if err := s.unindexCleared(ctx, s.sid); err != nil {
+		return err
+	}
+	info, _ := s.info()
+	if err := index.IndexSession(ctx, info); err != nil {
+		return err
+	}
+	if oldUserId != "" && oldUserId != userId {
+		return index.UnindexSession(ctx, oldUserId, s.sid)
+	}
+	return nil
+}
+
+func (s *session) UserId() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.reserved(userIdKey)
+}
+
+// info returns the metadata of the session if it's bound to a user. mutex must be held.
+func (s *session) info() (SessionInfo, bool) {
+	userId := s.reserved(userIdKey)
+	if userId == "" {
+		return SessionInfo{}, false
+	}
+	return SessionInfo{
+		SessionId: s.sid,
+		UserId:    userId,
+		CreatedAt: s.createdAt,
+		LastSeen:  time.Now(),
+		IP:        s.reserved(clientIPKey),
+		UserAgent: s.reserved(userAgentKey),
+	}, true
+}
+
+// reserved returns the string value of the reserved key, or empty string if not found. mutex must be held.
+func (s *session) reserved(key string) string {
+	var v string
+	if raw, ok := s.values[key]; ok {
+		_ = s.codec.Unmarshal(raw, &v)
+	}
+	return v
 }
 
 func (s *session) SessionId() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	return s.sid
 }
 
@@ -135,13 +714,162 @@ func WithExpiration(expiration time.Duration) SessionOptions {
 	})
 }
 
-// WithRedisTimeout specifies the redis timeout
+// WithRedisTimeout specifies the timeout of each redis call, 5s by default. Non positive value means no timeout
+// besides the one of the context.
 func WithRedisTimeout(timeout time.Duration) SessionOptions {
 	return newFuncOption(func(option *sessionOptions) {
 		option.RedisTimeout = timeout
 	})
 }
 
+// WithRedisClient specifies the redis client to store the sessions, e.g. redis.NewClient, redis.NewClusterClient or
+// redis.NewFailoverClient, which takes precedence over WithRedisOptions and WithRedisClusters.
+func WithRedisClient(client redis.UniversalClient) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.RedisClient = client
+	})
+}
+
+// WithRedisOptions specifies the options to create the redis client, including password, DB, TLS, pool size etc.
+// A failover client is created if MasterName is set, a cluster client if there are multiple addresses, otherwise a
+// single node client. It takes precedence over WithRedisClusters. The client is created once for each options pointer
+// and shared by all the sessions, hence options must not be modified afterwards.
+func WithRedisOptions(options *redis.UniversalOptions) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.RedisOptions = options
+	})
+}
+
+// WithRedisHashStorage keeps each session as a redis hash, whose fields are written by HSET and HDEL only if they're
+// changed, which cuts the bandwidth for large sessions and makes the concurrent changes of different keys safe. The
+// sessions saved as a whole can't be read in this mode.
+func WithRedisHashStorage() SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.RedisHash = true
+	})
+}
+
+// WithRedisKeyPrefix specifies the prefix of the redis keys, e.g. "session:", so that the sessions don't collide with
+// other data. No prefix by default, which is compatible with the sessions saved by previous versions.
+func WithRedisKeyPrefix(prefix string) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.RedisKeyPrefix = prefix
+	})
+}
+
+// WithCodec specifies the codec serializing the session values, JSONCodec by default. GobCodec and MsgpackCodec are
+// available as well.
+func WithCodec(codec Codec) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.Codec = codec
+	})
+}
+
+// WithSessionIdGenerator specifies the generator of session ids, UUIDGenerator by default. Base64IdGenerator generates
+// longer ids. Changing the generator invalidates the existing sessions whose ids are rejected by the new one.
+func WithSessionIdGenerator(generator SessionIdGenerator) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.IdGenerator = generator
+	})
+}
+
+// WithPayloadEncryption encrypts the sessions with AES-GCM before they're written to the store, see
+// NewEncryptedSessionStore. Each key must be 16, 24 or 32 bytes, the first one encrypts the sessions while all of them
+// are tried when decrypting.
+func WithPayloadEncryption(keys ...[]byte) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.PayloadKeys = keys
+	})
+}
+
+// WithPayloadPlaintextFallback accepts the sessions saved without encryption when WithPayloadEncryption is specified,
+// see WithPlaintextFallback.
+func WithPayloadPlaintextFallback() SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.PayloadOptions = append(option.PayloadOptions, WithPlaintextFallback())
+	})
+}
+
+// WithIdleTimeout enables sliding expiration: the session expires if it's not accessed for timeout, and each
+// CreateSession loading it extends its expiration in the store. It takes precedence over WithExpiration.
+func WithIdleTimeout(timeout time.Duration) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.IdleTimeout = timeout
+	})
+}
+
+// WithAbsoluteTimeout specifies the hard limit of the session lifetime counted from its creation, regardless of
+// activity. The creation time is stored in the session metadata.
+func WithAbsoluteTimeout(timeout time.Duration) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.AbsoluteTimeout = timeout
+	})
+}
+
+// WithFallbackOnStoreError makes CreateSession create a new session instead of returning error if the store fails
+// to load the session, e.g. redis is unavailable. Users are logged out in that case, which some applications prefer to
+// failing the requests.
+func WithFallbackOnStoreError() SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.FallbackOnStoreError = true
+	})
+}
+
+// ConflictPolicy decides what to do if the session has been saved by others since loaded, which is detected only if
+// the store is a VersionedSessionStore.
+type ConflictPolicy int
+
+const (
+	// ConflictMerge applies the keys set or deleted by the session to the latest values and saves them, so that
+	// concurrent requests changing different keys don't lose each other's changes. The later one wins if they change
+	// the same key. It's the default policy.
+	ConflictMerge ConflictPolicy = iota
+	// ConflictFail makes Save return ErrSessionConflict.
+	ConflictFail
+)
+
+// WithConflictPolicy specifies what to do if the session has been saved by others since loaded, ConflictMerge by
+// default. Save returns ErrSessionConflict under both policies if the session has been removed from the store.
+func WithConflictPolicy(policy ConflictPolicy) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.ConflictPolicy = policy
+	})
+}
+
+// WithOnCreate specifies the hook called when a new session is saved to the store for the first time. The sessions
+// created by CreateSession but never saved don't trigger it.
+func WithOnCreate(hook SessionHook) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.Hooks.OnCreate = append(option.Hooks.OnCreate, hook)
+	})
+}
+
+// WithOnSave specifies the hook called each time the session is saved to the store.
+func WithOnSave(hook SessionHook) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.Hooks.OnSave = append(option.Hooks.OnSave, hook)
+	})
+}
+
+// WithOnDestroy specifies the hook called after the session is destroyed by Session.Destroy.
+func WithOnDestroy(hook SessionHook) SessionOptions {
+	return newFuncOption(func(option *sessionOptions) {
+		option.Hooks.OnDestroy = append(option.Hooks.OnDestroy, hook)
+	})
+}
+
+// WithOnExpire specifies the hook called with the id of the session expired, which is registered on the store by
+// CreateSession. InMemorySessionStore calls it from its gc goroutine, and RedisSessionStore from ListenExpiry, which
+// must be run by users on the store returned by ResolveSessionStore. Sessions found past their absolute timeout by
+// CreateSession trigger it as well. The option should be created once and reused, hooks are registered once per option.
+func WithOnExpire(hook ExpireHook) SessionOptions {
+	o := &funcOption{}
+	o.f = func(option *sessionOptions) {
+		option.Hooks.OnExpire = append(option.Hooks.OnExpire, registeredExpireHook{key: o, hook: hook})
+	}
+	return o
+}
+
 // WithSessionStore specifies custom session store implementation. By default, if redis clusters are specified,
 // RedisSessionStore would be used which is implemented based on redis. Otherwise, InMemorySessionStore would be used,
 // which is implemented in memory. You can implement your session store using other persistent strategy such as database.
@@ -156,6 +884,63 @@ type sessionOptions struct {
 	Expiration    time.Duration
 	RedisTimeout  time.Duration
 	Store         SessionStore
+	Codec         Codec
+	IdGenerator   SessionIdGenerator
+
+	RedisClient    redis.UniversalClient
+	RedisOptions   *redis.UniversalOptions
+	RedisKeyPrefix string
+	RedisHash      bool
+
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+
+	PayloadKeys    [][]byte
+	PayloadOptions []EncryptedStoreOptions
+
+	FallbackOnStoreError bool
+	ConflictPolicy       ConflictPolicy
+	Hooks                sessionHooks
+}
+
+func newSessionOptions(options []SessionOptions) *sessionOptions {
+	opt := &sessionOptions{RedisClusters: nil, Expiration: 24 * time.Hour, RedisTimeout: 5 * time.Second, Codec: JSONCodec{},
+		IdGenerator: UUIDGenerator{}}
+	for _, o := range options {
+		o.apply(opt)
+	}
+	return opt
+}
+
+// ResolveSessionStore returns the store CreateSession uses with options, with the hooks specified by WithOnExpire
+// registered: the store specified by WithSessionStore, the redis store shared by the calls with the same redis
+// options, or the InMemorySessionStore shared by the process. It's useful to run ListenExpiry on the redis store created
+// for WithRedisClusters or WithRedisOptions, which is not wrapped unless WithPayloadEncryption is specified.
+func ResolveSessionStore(options ...SessionOptions) (SessionStore, error) {
+	opt := newSessionOptions(options)
+	store, err := resolveStore(opt)
+	if err != nil {
+		return nil, err
+	}
+	registerExpireHooks(store, opt.Hooks.OnExpire)
+	return store, nil
+}
+
+// resolveStore returns the store specified by options, see CreateSession.
+func resolveStore(opt *sessionOptions) (SessionStore, error) {
+	var store SessionStore
+	var err error
+	if opt.Store != nil {
+		store = opt.Store
+	} else if len(opt.RedisClusters) != 0 || opt.RedisClient != nil || opt.RedisOptions != nil {
+		store, err = NewRedisSessionStore(opt)
+	} else {
+		store = sharedMemoryStore()
+	}
+	if err != nil || len(opt.PayloadKeys) == 0 {
+		return store, err
+	}
+	return NewEncryptedSessionStore(store, opt.PayloadKeys, opt.PayloadOptions...)
 }
 
 type funcOption struct {
@@ -170,22 +955,30 @@ func newFuncOption(f func(option *sessionOptions)) SessionOptions {
 	return &funcOption{f: f}
 }
 
-func newUUID() string {
-	var buf [16]byte
-	io.ReadFull(rand.Reader, buf[:])
-	buf[6] = (buf[6] & 0x0f) | 0x40
-	buf[8] = (buf[8] & 0x3f) | 0x80
-
-	dst := make([]byte, 36)
-	hex.Encode(dst, buf[:4])
-	dst[8] = '-'
-	hex.Encode(dst[9:13], buf[4:6])
-	dst[13] = '-'
-	hex.Encode(dst[14:18], buf[6:8])
-	dst[18] = '-'
-	hex.Encode(dst[19:23], buf[8:10])
-	dst[23] = '-'
-	hex.Encode(dst[24:], buf[10:])
+const (
+	// reservedKeyPrefix prefixes the keys used by sessionlib itself, which shouldn't be used by users.
+	reservedKeyPrefix = "__sessionlib."
+	createdAtKey      = reservedKeyPrefix + "created_at"
+	userIdKey         = reservedKeyPrefix + "user_id"
+	clientIPKey       = reservedKeyPrefix + "client_ip"
+	userAgentKey      = reservedKeyPrefix + "user_agent"
+)
 
-	return string(dst)
+// clearedReservedKeys are the reserved keys deleted by Clear, the others are kept as the metadata of the session.
+var clearedReservedKeys = map[string]bool{
+	userIdKey:    true,
+	clientIPKey:  true,
+	userAgentKey: true,
+	flashesKey:   true,
+	csrfTokenKey: true,
 }
+
+var (
+	ErrSessionNotFound  = errors.New("session not found")
+	ErrValueNotFound    = errors.New("session value not found")
+	ErrSessionDestroyed = errors.New("session destroyed")
+	// ErrSessionConflict means the session has been saved or removed by others since loaded.
+	ErrSessionConflict = errors.New("session modified concurrently")
+	// ErrIndexNotSupported means the store doesn't implement SessionIndex.
+	ErrIndexNotSupported = errors.New("session index not supported by store")
+)
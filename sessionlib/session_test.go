@@ -2,6 +2,10 @@ package sessionlib
 
 import (
 	"context"
+	"encoding/gob"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"sync"
 	"testing"
 	"time"
 )
@@ -74,3 +78,582 @@ func TestSession(t *testing.T) {
 		t.Logf("value: %s", v.(string))
 	}
 }
+
+type testProfile struct {
+	Name  string
+	Roles []string
+}
+
+func TestSessionCodec(t *testing.T) {
+	gob.Register(testProfile{})
+	for _, codec := range []Codec{JSONCodec{}, GobCodec{}, MsgpackCodec{}} {
+		var sid string
+		store := NewInMemorySessionStore()
+		t.Cleanup(func() {
+			_ = store.Close()
+		})
+		options := []SessionOptions{WithSessionStore(store), WithCodec(codec)}
+		getter := func() string {
+			return sid
+		}
+		setter := func(s string) {
+			sid = s
+		}
+		s, err := CreateSession(getter, setter, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = s.Set("profile", testProfile{Name: "alice", Roles: []string{"admin"}})
+		_ = s.Set("visits", 3)
+		if err := s.Save(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err = CreateSession(getter, setter, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := GetAs[testProfile](s, "profile")
+		if err != nil || p.Name != "alice" || len(p.Roles) != 1 {
+			t.Fatalf("%T: unexpected profile %+v, %v", codec, p, err)
+		}
+		if v, err := GetAs[int](s, "visits"); err != nil || v != 3 {
+			t.Fatalf("%T: unexpected visits %d, %v", codec, v, err)
+		}
+		if _, err := GetAs[int](s, "missing"); err != ErrValueNotFound {
+			t.Fatalf("%T: expected ErrValueNotFound, got %v", codec, err)
+		}
+	}
+}
+
+func TestSessionLifecycle(t *testing.T) {
+	for _, st := range newStoresUnderTest(t) {
+		t.Run(st.name, func(t *testing.T) {
+			store := st.store
+			var sid string
+			getter := func() string {
+				return sid
+			}
+			setter := func(s string) {
+				sid = s
+			}
+			s, err := CreateSession(getter, setter, []SessionOptions{WithSessionStore(store)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = s.Set("user", "alice")
+			_ = s.Set("theme", "dark")
+			if err := s.Save(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			oldId := sid
+			if err := s.RegenerateId(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if sid == oldId || sid != s.SessionId() {
+				t.Fatalf("session id not regenerated: %s", sid)
+			}
+			if _, err := store.Get(context.Background(), oldId); err == nil {
+				t.Fatal("old session not removed")
+			}
+
+			s, _ = CreateSession(getter, setter, []SessionOptions{WithSessionStore(store)})
+			if v, ok := s.Get("user"); !ok || v != "alice" {
+				t.Fatalf("session lost after regeneration: %v", v)
+			}
+			s.Delete("theme")
+			if _, ok := s.Get("theme"); ok {
+				t.Fatal("key not deleted")
+			}
+
+			destroyed := sid
+			if err := s.Destroy(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if sid != "" {
+				t.Fatalf("session id not cleared: %s", sid)
+			}
+			if _, err := store.Get(context.Background(), destroyed); err == nil {
+				t.Fatal("destroyed session not removed")
+			}
+			if err := s.Save(context.Background()); err != ErrSessionDestroyed {
+				t.Fatalf("expected ErrSessionDestroyed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	store := NewInMemorySessionStore()
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	expired := make(chan string, 10)
+	store.OnExpire(func(sessionId string) {
+		expired <- sessionId
+	})
+	var sid string
+	getter := func() string {
+		return sid
+	}
+	setter := func(s string) {
+		sid = s
+	}
+	options := []SessionOptions{
+		WithSessionStore(store), WithIdleTimeout(200 * time.Millisecond), WithAbsoluteTimeout(500 * time.Millisecond),
+	}
+	s, err := CreateSession(getter, setter, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Set("user", "alice")
+	if err := s.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	created := sid
+
+	// each access slides the idle timeout
+	for i := 0; i < 3; i++ {
+		time.Sleep(120 * time.Millisecond)
+		if _, err := CreateSession(getter, setter, options); err != nil {
+			t.Fatal(err)
+		}
+		if sid != created {
+			t.Fatalf("session expired while active after %d accesses", i)
+		}
+	}
+	// the absolute timeout can't be extended
+	time.Sleep(150 * time.Millisecond)
+	if _, err := CreateSession(getter, setter, options); err != nil {
+		t.Fatal(err)
+	}
+	if sid == created {
+		t.Fatal("session outlived absolute timeout")
+	}
+	if id := <-expired; id != created {
+		t.Fatalf("expected %s expired, got %s", created, id)
+	}
+
+	created = sid
+	s, _ = CreateSession(getter, setter, options)
+	_ = s.Set("user", "bob")
+	_ = s.Save(context.Background())
+	time.Sleep(250 * time.Millisecond)
+	if _, err := CreateSession(getter, setter, options); err != nil {
+		t.Fatal(err)
+	}
+	if sid == created {
+		t.Fatal("idle session not expired")
+	}
+}
+
+func TestSessionConflict(t *testing.T) {
+	for _, st := range newStoresUnderTest(t) {
+		t.Run(st.name, func(t *testing.T) {
+			ctx := context.Background()
+			vs, ok := st.store.(VersionedSessionStore)
+			if !ok {
+				t.Fatal("expected VersionedSessionStore")
+			}
+			key := "cas"
+			version, err := vs.CompareAndSet(ctx, key, "v1", "", time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := vs.CompareAndSet(ctx, key, "v2", "", time.Minute); err != ErrSessionConflict {
+				t.Fatalf("expected ErrSessionConflict, got %v", err)
+			}
+			if _, err := vs.CompareAndSet(ctx, key, "v2", version, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := vs.CompareAndSet(ctx, key, "v3", version, time.Minute); err != ErrSessionConflict {
+				t.Fatalf("expected ErrSessionConflict on stale version, got %v", err)
+			}
+
+			sid := ""
+			load := func(options ...SessionOptions) Session {
+				s, err := CreateSession(func() string {
+					return sid
+				}, func(s string) {
+					sid = s
+				}, append([]SessionOptions{WithSessionStore(st.store)}, options...))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}
+			s := load()
+			_ = s.Set("shared", "origin")
+			_ = s.Set("removed", "origin")
+			if err := s.Save(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			// concurrent changes of different keys are merged
+			s1, s2 := load(), load()
+			_ = s1.Set("a", "1")
+			s1.Delete("removed")
+			_ = s1.Set("shared", "s1")
+			if err := s1.Save(ctx); err != nil {
+				t.Fatal(err)
+			}
+			_ = s2.Set("b", "2")
+			_ = s2.Set("shared", "s2")
+			if err := s2.Save(ctx); err != nil {
+				t.Fatal(err)
+			}
+			s = load()
+			for k, expected := range map[string]string{"a": "1", "b": "2", "shared": "s2"} {
+				if v, _ := s.Get(k); v != expected {
+					t.Fatalf("expected %s=%s, got %v", k, expected, v)
+				}
+			}
+			if _, ok := s.Get("removed"); ok {
+				t.Fatal("deleted key brought back")
+			}
+
+			// or rejected
+			s1, s2 = load(WithConflictPolicy(ConflictFail)), load(WithConflictPolicy(ConflictFail))
+			_ = s1.Set("a", "3")
+			if err := s1.Save(ctx); err != nil {
+				t.Fatal(err)
+			}
+			_ = s2.Set("b", "3")
+			if err := s2.Save(ctx); err != ErrSessionConflict {
+				t.Fatalf("expected ErrSessionConflict, got %v", err)
+			}
+
+			// destroyed sessions are not brought back by merging
+			s1, s2 = load(), load()
+			if err := s1.Destroy(ctx); err != nil {
+				t.Fatal(err)
+			}
+			_ = s2.Set("b", "4")
+			if err := s2.Save(ctx); err != ErrSessionConflict {
+				t.Fatalf("expected ErrSessionConflict, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSessionIndex(t *testing.T) {
+	for _, st := range newStoresUnderTest(t) {
+		t.Run(st.name, func(t *testing.T) {
+			ctx := context.Background()
+			index := st.store.(SessionIndex)
+			login := func(userId string, ip string) (Session, *string) {
+				sid := new(string)
+				s, err := CreateSession(func() string {
+					return *sid
+				}, func(s string) {
+					*sid = s
+				}, []SessionOptions{WithSessionStore(st.store)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.BindUser(ctx, userId, ClientInfo{IP: ip, UserAgent: "test"}); err != nil {
+					t.Fatal(err)
+				}
+				return s, sid
+			}
+			alice := "alice"
+			s1, _ := login(alice, "10.0.0.1")
+			s2, _ := login(alice, "10.0.0.2")
+			bob := "bob"
+			s3, sid3 := login(bob, "10.0.0.3")
+			if s1.UserId() != alice {
+				t.Fatalf("expected user %s, got %s", alice, s1.UserId())
+			}
+			infos, err := index.ListSessions(ctx, alice)
+			if err != nil || len(infos) != 2 {
+				t.Fatalf("expected 2 sessions, got %v, %v", infos, err)
+			}
+			for _, info := range infos {
+				if info.UserAgent != "test" || info.IP == "" || info.CreatedAt.IsZero() || info.LastSeen.IsZero() {
+					t.Fatalf("unexpected info %+v", info)
+				}
+			}
+
+			oldId := s1.SessionId()
+			if err := s1.RegenerateId(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := s2.Destroy(ctx); err != nil {
+				t.Fatal(err)
+			}
+			infos, err = index.ListSessions(ctx, alice)
+			if err != nil || len(infos) != 1 || infos[0].SessionId != s1.SessionId() || infos[0].SessionId == oldId {
+				t.Fatalf("expected the regenerated session only, got %v, %v", infos, err)
+			}
+
+			if err := index.RevokeAll(ctx, alice); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := st.store.Get(ctx, s1.SessionId()); err != ErrSessionNotFound {
+				t.Fatalf("expected session revoked, got %v", err)
+			}
+			if infos, err := index.ListSessions(ctx, alice); err != nil || len(infos) != 0 {
+				t.Fatalf("expected no session, got %v, %v", infos, err)
+			}
+			// sessions of others are not affected
+			s, err := CreateSession(func() string {
+				return *sid3
+			}, nil, []SessionOptions{WithSessionStore(st.store)})
+			if err != nil || s.SessionId() != s3.SessionId() || s.UserId() != bob {
+				t.Fatalf("expected the session of bob, got %v", err)
+			}
+
+			// the user is unbound once the session is cleared and saved
+			s.Clear()
+			if err := s.Save(ctx); err != nil {
+				t.Fatal(err)
+			}
+			s, err = CreateSession(func() string {
+				return *sid3
+			}, nil, []SessionOptions{WithSessionStore(st.store)})
+			if err != nil || s.SessionId() != s3.SessionId() || s.UserId() != "" {
+				t.Fatalf("expected the session unbound, got %q, %v", s.UserId(), err)
+			}
+			if infos, err := index.ListSessions(ctx, bob); err != nil || len(infos) != 0 {
+				t.Fatalf("expected no session, got %v, %v", infos, err)
+			}
+		})
+	}
+
+	cookieStore, err := NewCookieSessionStore([][]byte{make([]byte, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := CreateSession(func() string {
+		return ""
+	}, nil, []SessionOptions{WithSessionStore(cookieStore)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.BindUser(context.Background(), "alice", ClientInfo{}); err != ErrIndexNotSupported {
+		t.Fatalf("expected ErrIndexNotSupported, got %v", err)
+	}
+}
+
+func TestSessionHooks(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemorySessionStore()
+	defer store.Close()
+	var mutex sync.Mutex
+	events := make(map[string]int)
+	record := func(event string) SessionHook {
+		return func(ctx context.Context, s Session) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			events[event]++
+		}
+	}
+	count := func(event string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return events[event]
+	}
+	expired := make(chan string, 10)
+	options := []SessionOptions{
+		WithSessionStore(store),
+		WithExpiration(50 * time.Millisecond),
+		WithOnCreate(record("create")),
+		WithOnSave(record("save")),
+		WithOnDestroy(record("destroy")),
+		WithOnExpire(func(sessionId string) {
+			expired <- sessionId
+		}),
+	}
+	var sid string
+	load := func() Session {
+		s, err := CreateSession(func() string {
+			return sid
+		}, func(s string) {
+			sid = s
+		}, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := load()
+	if count("create") != 0 {
+		t.Fatal("session not saved shouldn't trigger OnCreate")
+	}
+	_ = s.Set("key", "value")
+	if err := s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s = load()
+	_ = s.Set("key", "value2")
+	if err := s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count("create") != 1 || count("save") != 2 {
+		t.Fatalf("unexpected events %v", events)
+	}
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count("destroy") != 1 {
+		t.Fatalf("unexpected events %v", events)
+	}
+
+	// the hook is registered once although the option is used by CreateSession repeatedly
+	s = load()
+	_ = s.Set("key", "value")
+	if err := s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-expired:
+		if id != s.SessionId() {
+			t.Fatalf("expected %s expired, got %s", s.SessionId(), id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnExpire not called")
+	}
+	select {
+	case id := <-expired:
+		t.Fatalf("OnExpire called repeatedly for %s", id)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRedisListenExpiry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	expired := make(chan string, 10)
+	options := []SessionOptions{
+		WithRedisClusters([]string{mr.Addr()}),
+		WithRedisKeyPrefix("session:"),
+		WithOnExpire(func(sessionId string) {
+			expired <- sessionId
+		}),
+	}
+	// the store created by CreateSession keeps the hook, which is the one returned by ResolveSessionStore
+	if _, err := CreateSession(func() string {
+		return ""
+	}, nil, options); err != nil {
+		t.Fatal(err)
+	}
+	store, err := ResolveSessionStore(options[:2]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisStore := store.(*RedisSessionStore)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- redisStore.ListenExpiry(ctx)
+	}()
+	for mr.PubSubNumPat() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// miniredis doesn't send keyspace notifications, which are simulated here
+	mr.Publish("__keyevent@0__:expired", "other")
+	mr.Publish("__keyevent@0__:expired", "session:info:1234")
+	mr.Publish("__keyevent@0__:expired", "session:1234")
+	select {
+	case id := <-expired:
+		if id != "1234" {
+			t.Fatalf("expected 1234 expired, got %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnExpire not called")
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(expired) != 0 {
+		t.Fatal("keys not sessions shouldn't trigger OnExpire")
+	}
+}
+
+// readCountingStore counts the reads of the store.
+type readCountingStore struct {
+	SessionStore
+	reads int
+}
+
+func (c *readCountingStore) Get(ctx context.Context, key string) (string, error) {
+	c.reads++
+	return c.SessionStore.Get(ctx, key)
+}
+
+// failingGenerator fails to generate ids.
+type failingGenerator struct {
+	Base64IdGenerator
+}
+
+func (failingGenerator) Generate() (string, error) {
+	return "", errors.New("entropy exhausted")
+}
+
+func TestSessionIdGenerator(t *testing.T) {
+	for _, g := range []SessionIdGenerator{UUIDGenerator{}, Base64IdGenerator{}} {
+		id, err := g.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !g.Validate(id) {
+			t.Fatalf("expected %v valid", id)
+		}
+		for _, malformed := range []string{"", id[1:], id + "a", id[:len(id)-1] + "*", "../" + id[3:]} {
+			if g.Validate(malformed) {
+				t.Fatalf("expected %v invalid", malformed)
+			}
+		}
+	}
+
+	memory := NewInMemorySessionStore()
+	defer memory.Close()
+	store := &readCountingStore{SessionStore: memory}
+	sid := "attacker-chosen"
+	getter := func() string {
+		return sid
+	}
+	setter := func(s string) {
+		sid = s
+	}
+	options := []SessionOptions{WithSessionStore(store), WithSessionIdGenerator(Base64IdGenerator{})}
+	s, err := CreateSession(getter, setter, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.reads != 0 {
+		t.Fatal("expected the malformed id rejected before reading the store")
+	}
+	if !(Base64IdGenerator{}).Validate(s.SessionId()) || sid != s.SessionId() {
+		t.Fatalf("expected a new id generated, got %v", s.SessionId())
+	}
+	_ = s.Set("key", "value")
+	if err := s.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = CreateSession(getter, setter, options); err != nil || store.reads != 1 {
+		t.Fatalf("expected the session loaded, got %v", err)
+	}
+	if v, _ := s.Get("key"); v != "value" {
+		t.Fatalf("expected value, got %v", v)
+	}
+
+	// the errors of the generator are surfaced
+	failing := []SessionOptions{WithSessionStore(store), WithSessionIdGenerator(failingGenerator{})}
+	sid = ""
+	if _, err := CreateSession(getter, setter, failing); err == nil {
+		t.Fatal("expected generator error")
+	}
+	if err := s.RegenerateId(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sid = s.SessionId()
+	s, err = CreateSession(getter, setter, failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegenerateId(context.Background()); err == nil || s.SessionId() != sid {
+		t.Fatal("expected generator error keeping the id")
+	}
+}
@@ -0,0 +1,152 @@
+package sessionlib
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// memorySnapshotVersion is the version of the snapshot format, which is increased once the format changes.
+const memorySnapshotVersion = 1
+
+// memorySnapshot is the content of a snapshot of InMemorySessionStore, encoded by gob.
+type memorySnapshot struct {
+	Version int
+	// Entries are ordered from the least recently used one to the most recently used one.
+	Entries []memorySnapshotEntry
+	// Sessions are the associations of the sessions in Entries with their users.
+	Sessions []SessionInfo
+}
+
+type memorySnapshotEntry struct {
+	Key   string
+	Value string
+	// Deadline is the absolute expiration time, zero if the entry never expires.
+	Deadline time.Time
+}
+
+// Snapshot writes all the unexpired sessions together with their deadlines and the session index to w, which can be
+// loaded by Restore. The store is locked only while the sessions are collected, not while they're written.
+func (s *InMemorySessionStore) Snapshot(w io.Writer) error {
+	snapshot := memorySnapshot{Version: memorySnapshotVersion}
+	s.mutex.Lock()
+	now := time.Now()
+	for element := s.lru.Back(); element != nil; element = element.Prev() {
+		e := element.Value.(*memoryEntry)
+		if e.expired(now) {
+			continue
+		}
+		snapshot.Entries = append(snapshot.Entries, memorySnapshotEntry{Key: e.key, Value: e.value, Deadline: e.deadline})
+		if userId, ok := s.users[e.key]; ok {
+			snapshot.Sessions = append(snapshot.Sessions, s.index[userId][e.key])
+		}
+	}
+	s.mutex.Unlock()
+	if err := gob.NewEncoder(w).Encode(&snapshot); err != nil {
+		return fmt.Errorf("fail to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// Restore loads the sessions written by Snapshot into the store, replacing the sessions with the same ids. Sessions keep
+// their deadlines, so they expire after the remaining ttl at the time of the snapshot, minus the time elapsed since then.
+// The sessions expired in the meantime are dropped, calling the hooks registered by OnExpire.
+func (s *InMemorySessionStore) Restore(r io.Reader) error {
+	var snapshot memorySnapshot
+	if err := gob.NewDecoder(r).Decode(&snapshot); err != nil {
+		return fmt.Errorf("fail to read snapshot: %w", err)
+	}
+	if snapshot.Version != memorySnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	var expired []string
+	s.mutex.Lock()
+	now := time.Now()
+	for _, entry := range snapshot.Entries {
+		if !entry.Deadline.IsZero() && !entry.Deadline.After(now) {
+			expired = append(expired, entry.Key)
+			continue
+		}
+		s.putUntil(entry.Key, entry.Value, s.nextVersion(), entry.Deadline)
+	}
+	for _, info := range snapshot.Sessions {
+		if _, ok := s.data[info.SessionId]; ok {
+			s.indexSession(info)
+		}
+	}
+	s.unlock()
+	for _, key := range expired {
+		s.hooks.fire(key)
+	}
+	return nil
+}
+
+// SnapshotFile writes the snapshot to the file at path atomically: it's written to a temporary file in the same
+// directory first, which then replaces the file by renaming, so that the file is never left partially written.
+func (s *InMemorySessionStore) SnapshotFile(path string) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("fail to create snapshot file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	w := bufio.NewWriter(f)
+	if err := s.Snapshot(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("fail to write snapshot: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("fail to write snapshot: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("fail to write snapshot: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("fail to replace snapshot file: %w", err)
+	}
+	return nil
+}
+
+// RestoreFile loads the snapshot written by SnapshotFile. It does nothing if the file doesn't exist, so that it can be
+// called on the first start as well.
+func (s *InMemorySessionStore) RestoreFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fail to open snapshot file: %w", err)
+	}
+	defer f.Close()
+	return s.Restore(bufio.NewReader(f))
+}
+
+// snapshotLoop writes the snapshot file periodically until the store is closed.
+func (s *InMemorySessionStore) snapshotLoop(path string, interval time.Duration) {
+	defer close(s.snapshotDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if err := s.SnapshotFile(path); err != nil {
+				s.mutex.Lock()
+				s.stats.SnapshotFailures++
+				s.mutex.Unlock()
+			}
+		}
+	}
+}
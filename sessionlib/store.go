@@ -7,10 +7,67 @@ import (
 
 // SessionStore represents the store strategy of session, which can be mysql, in memory or redis etc.
 type SessionStore interface {
-	// Get gets the value of specified key, returning the value and error if any.
+	// Get gets the value of specified key, returning the value and error if any. ErrSessionNotFound must be returned
+	// if the key doesn't exist, so that it's distinguished from the failures of the store.
 	Get(ctx context.Context, key string) (string, error)
-	// Set adds the key-value pair with expiration specified. If key exists, nothing would happen.
+	// Set adds the key-value pair with expiration specified. If key exists, its value and expiration are replaced.
+	// If expiration is not positive, the key never expires.
 	Set(ctx context.Context, key string, value string, expiration time.Duration) error
+	// SetNX adds the key-value pair with expiration specified only if key doesn't exist, returning whether it's added.
+	SetNX(ctx context.Context, key string, value string, expiration time.Duration) (bool, error)
+	// Touch resets the expiration of the key without changing its value, returning ErrSessionNotFound if key doesn't
+	// exist.
+	Touch(ctx context.Context, key string, expiration time.Duration) error
 	// Delete deletes the key. If key doesn't exist, do nothing.
 	Delete(ctx context.Context, key string) error
 }
+
+// VersionedSessionStore is implemented by the stores supporting optimistic concurrency, with which the sessions saved
+// concurrently don't overwrite each other silently. Versions are opaque strings produced by the store.
+type VersionedSessionStore interface {
+	SessionStore
+	// GetVersioned gets the value of key together with its current version, returning ErrSessionNotFound if the key
+	// doesn't exist.
+	GetVersioned(ctx context.Context, key string) (value string, version string, err error)
+	// CompareAndSet sets the key-value pair only if the current version of key equals version, returning the new
+	// version. Empty version means the key must not exist. ErrSessionConflict is returned if the version doesn't match.
+	CompareAndSet(ctx context.Context, key string, value string, version string, expiration time.Duration) (string, error)
+}
+
+// FieldSessionStore is implemented by the stores keeping each value of the session separately, with which only the
+// values changed are written when the session is saved, and concurrent changes of different keys don't overwrite
+// each other. Sessions use GetFields and UpdateFields instead of Get and Set of such stores.
+type FieldSessionStore interface {
+	SessionStore
+	// GetFields gets the encoded values of the session, returning ErrSessionNotFound if it doesn't exist.
+	GetFields(ctx context.Context, key string) (map[string][]byte, error)
+	// UpdateFields sets and deletes the values of the session and resets its expiration. If replace is true, the
+	// session is replaced by set, otherwise ErrSessionConflict is returned if the session doesn't exist, so that the
+	// sessions removed by others are not brought back partially.
+	UpdateFields(ctx context.Context, key string, set map[string][]byte, deleted []string, replace bool,
+		expiration time.Duration) error
+}
+
+// SessionInfo is the metadata of a session associated with a user by Session.BindUser.
+type SessionInfo struct {
+	SessionId string
+	UserId    string
+	CreatedAt time.Time
+	// LastSeen is updated each time the session is loaded by CreateSession.
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+}
+
+// SessionIndex is implemented by the stores able to find the sessions of a user, so that all of them can be revoked
+// on password change etc. The associations of the sessions expired or deleted are removed by the store eventually.
+type SessionIndex interface {
+	// IndexSession associates the session with the user, replacing the metadata if it's associated already.
+	IndexSession(ctx context.Context, info SessionInfo) error
+	// UnindexSession removes the association of the session with the user. If it's not associated, do nothing.
+	UnindexSession(ctx context.Context, userId string, sessionId string) error
+	// ListSessions lists the alive sessions of the user.
+	ListSessions(ctx context.Context, userId string) ([]SessionInfo, error)
+	// RevokeAll deletes all the sessions of the user together with the associations.
+	RevokeAll(ctx context.Context, userId string) error
+}
@@ -0,0 +1,824 @@
+package sessionlib
+
+import (
+	"bytes"
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storeUnderTest is a store together with the way to let its keys expire.
+type storeUnderTest struct {
+	name    string
+	store   SessionStore
+	advance func(d time.Duration)
+}
+
+func newStoresUnderTest(t *testing.T) []storeUnderTest {
+	mr := miniredis.RunT(t)
+	redisStore, err := NewRedisSessionStore(&sessionOptions{RedisClusters: []string{mr.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memoryStore := NewInMemorySessionStore()
+	t.Cleanup(func() {
+		_ = memoryStore.Close()
+	})
+	return []storeUnderTest{
+		{name: "memory", store: memoryStore, advance: time.Sleep},
+		{name: "redis", store: redisStore, advance: mr.FastForward},
+		{name: "sqlite", store: newSqliteStore(t), advance: time.Sleep},
+	}
+}
+
+func newSqliteStore(t *testing.T, options ...GormStoreOptions) *GormSessionStore {
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "sessions.db")), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewGormSessionStore(db, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return store
+}
+
+func TestStoreContract(t *testing.T) {
+	for _, st := range newStoresUnderTest(t) {
+		t.Run(st.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := st.store
+			key := "contract"
+			if _, err := s.Get(ctx, key); err != ErrSessionNotFound {
+				t.Fatalf("expected ErrSessionNotFound, got %v", err)
+			}
+			if err := s.Set(ctx, key, "v1", time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			// Set overwrites
+			if err := s.Set(ctx, key, "v2", time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			if v, err := s.Get(ctx, key); err != nil || v != "v2" {
+				t.Fatalf("expected v2, got %q, %v", v, err)
+			}
+			// SetNX doesn't
+			if ok, err := s.SetNX(ctx, key, "v3", time.Minute); err != nil || ok {
+				t.Fatalf("SetNX overwrote existing key: %v, %v", ok, err)
+			}
+			if v, _ := s.Get(ctx, key); v != "v2" {
+				t.Fatalf("expected v2, got %q", v)
+			}
+			if err := s.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Touch(ctx, key, time.Minute); err != ErrSessionNotFound {
+				t.Fatalf("expected ErrSessionNotFound, got %v", err)
+			}
+			if ok, err := s.SetNX(ctx, key, "v4", 50*time.Millisecond); err != nil || !ok {
+				t.Fatalf("SetNX failed on missing key: %v, %v", ok, err)
+			}
+			if v, err := s.Get(ctx, key); err != nil || v != "v4" {
+				t.Fatalf("expected v4, got %q, %v", v, err)
+			}
+			// Touch extends the expiration
+			st.advance(30 * time.Millisecond)
+			if err := s.Touch(ctx, key, 50*time.Millisecond); err != nil {
+				t.Fatal(err)
+			}
+			st.advance(30 * time.Millisecond)
+			if v, err := s.Get(ctx, key); err != nil || v != "v4" {
+				t.Fatalf("expected v4, got %q, %v", v, err)
+			}
+			st.advance(100 * time.Millisecond)
+			if _, err := s.Get(ctx, key); err != ErrSessionNotFound {
+				t.Fatalf("key not expired: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreFailure(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := NewRedisSessionStore(&sessionOptions{RedisClusters: []string{mr.Addr()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.Close()
+	const existing = "0b7d3a52-9b7c-4b1e-8f3a-2c1d5e6f7a8b"
+	sid := existing
+	getter := func() string {
+		return sid
+	}
+	setter := func(s string) {
+		sid = s
+	}
+	if _, err := CreateSession(getter, setter, []SessionOptions{WithSessionStore(store)}); err == nil {
+		t.Fatal("expected store error")
+	}
+	if sid != existing {
+		t.Fatal("session id overwritten on store error")
+	}
+	if _, err := CreateSession(getter, setter, []SessionOptions{WithSessionStore(store), WithFallbackOnStoreError()}); err != nil {
+		t.Fatal(err)
+	}
+	if sid == existing {
+		t.Fatal("expected a new session on fallback")
+	}
+}
+
+func TestGormSessionStoreReap(t *testing.T) {
+	store := newSqliteStore(t, WithGormReapInterval(0), WithGormReapBatchSize(2))
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		if err := store.Set(ctx, "expired-"+strconv.Itoa(i), "expired", 10*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Set(ctx, "alive", "alive", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(ctx, "forever", "forever", 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if n, err := store.Reap(ctx); err != nil || n != 5 {
+		t.Fatalf("expected 5 sessions reaped, got %d, %v", n, err)
+	}
+	var count int64
+	if err := store.db.Table(store.table).Count(&count).Error; err != nil || count != 2 {
+		t.Fatalf("expected 2 sessions left, got %d, %v", count, err)
+	}
+
+	// the background reaper
+	background := newSqliteStore(t, WithGormReapInterval(10*time.Millisecond))
+	if err := background.Set(ctx, "key", "value", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := background.db.Table(background.table).Count(&count).Error; err != nil || count != 0 {
+		t.Fatalf("expected expired session reaped, got %d, %v", count, err)
+	}
+}
+
+// deadlineHook records whether the redis calls carry a deadline.
+type deadlineHook struct {
+	missing int
+}
+
+func (h *deadlineHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		h.missing++
+	}
+	return ctx, nil
+}
+
+func (h *deadlineHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *deadlineHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *deadlineHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestRedisSessionStoreOptions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	hook := &deadlineHook{}
+	client.AddHook(hook)
+	var sid string
+	getter := func() string {
+		return sid
+	}
+	setter := func(s string) {
+		sid = s
+	}
+	options := []SessionOptions{WithRedisClient(client), WithRedisKeyPrefix("session:"), WithRedisTimeout(time.Second)}
+	s, err := CreateSession(getter, setter, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Set("key", "value")
+	if err := s.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !mr.Exists("session:"+sid) || mr.Exists(sid) {
+		t.Fatal("expected the key prefixed")
+	}
+	s, err = CreateSession(getter, setter, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("key"); v != "value" {
+		t.Fatalf("expected value, got %v", v)
+	}
+	if hook.missing != 0 {
+		t.Fatalf("%d redis calls without timeout", hook.missing)
+	}
+
+	// the client created with options, which is shared by the stores created with the same options
+	redisOptions := &redis.UniversalOptions{Addrs: []string{mr.Addr()}, DB: 1}
+	store, err := NewRedisSessionStore(newSessionOptions([]SessionOptions{WithRedisOptions(redisOptions)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	another, err := NewRedisSessionStore(newSessionOptions([]SessionOptions{WithRedisOptions(redisOptions)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.(*RedisSessionStore).client != another.(*RedisSessionStore).client {
+		t.Fatal("expected the client shared")
+	}
+	if err := store.Set(context.Background(), "db1", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	mr.Select(1)
+	if !mr.Exists("db1") {
+		t.Fatal("expected the key in db 1")
+	}
+}
+
+// countingStore counts the writes to the store.
+type countingStore struct {
+	SessionStore
+	writes int
+}
+
+func (c *countingStore) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	c.writes++
+	return c.SessionStore.Set(ctx, key, value, expiration)
+}
+
+func TestRedisHashSessionStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	sid := ""
+	load := func() Session {
+		s, err := CreateSession(func() string {
+			return sid
+		}, func(s string) {
+			sid = s
+		}, []SessionOptions{WithRedisClusters([]string{mr.Addr()}), WithRedisHashStorage()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := load()
+	_ = s.Set("name", "alice")
+	_ = s.Set("removed", 1)
+	if err := s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v := mr.HGet(sid, "name"); v != `"alice"` {
+		t.Fatalf("expected the value as a hash field, got %q", v)
+	}
+	if mr.TTL(sid) <= 0 {
+		t.Fatal("expected expiration set")
+	}
+
+	// concurrent changes of different fields
+	s1, s2 := load(), load()
+	_ = s1.Set("a", 1)
+	s1.Delete("removed")
+	_ = s2.Set("b", 2)
+	if err := s1.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s = load()
+	if v, _ := GetAs[int](s, "a"); v != 1 {
+		t.Fatalf("expected a=1, got %v", v)
+	}
+	if v, _ := GetAs[int](s, "b"); v != 2 {
+		t.Fatalf("expected b=2, got %v", v)
+	}
+	if _, ok := s.Get("removed"); ok {
+		t.Fatal("expected removed deleted")
+	}
+
+	// regenerated sessions are written as a whole
+	if err := s.RegenerateId(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := GetAs[string](load(), "name"); v != "alice" {
+		t.Fatalf("expected name=alice after regenerating id, got %v", v)
+	}
+
+	// destroyed sessions are not brought back partially
+	s1, s2 = load(), load()
+	if err := s1.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_ = s2.Set("c", 3)
+	if err := s2.Save(ctx); err != ErrSessionConflict {
+		t.Fatalf("expected ErrSessionConflict, got %v", err)
+	}
+}
+
+func TestSaveClean(t *testing.T) {
+	store := &countingStore{SessionStore: newSqliteStore(t)}
+	sid := ""
+	load := func() Session {
+		s, err := CreateSession(func() string {
+			return sid
+		}, func(s string) {
+			sid = s
+		}, []SessionOptions{WithSessionStore(store)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := load()
+	_ = s.Set("key", "value")
+	if err := s.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := load().Save(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if store.writes != 1 {
+		t.Fatalf("expected 1 write, got %d", store.writes)
+	}
+}
+
+func TestInMemorySessionStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemorySessionStore(WithMaxEntries(2))
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	_ = store.Set(ctx, "a", "a", time.Minute)
+	_ = store.Set(ctx, "b", "b", 0)
+	// a is used recently, so b is evicted
+	if _, err := store.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	_ = store.Set(ctx, "c", "c", time.Minute)
+	if _, err := store.Get(ctx, "b"); err != ErrSessionNotFound {
+		t.Fatalf("expected b evicted, got %v", err)
+	}
+	if _, err := store.Get(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := store.Stats(); stats.Entries != 2 || stats.Evictions != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// expired entries are removed by gc without being accessed
+	_ = store.Set(ctx, "a", "a", 20*time.Millisecond)
+	_ = store.Set(ctx, "c", "c", 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if stats := store.Stats(); stats.Entries != 0 || stats.Expirations != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hooks are called by the lookup once the store is closed, without gc
+	var expired []string
+	store.OnExpire(func(sessionId string) {
+		expired = append(expired, sessionId)
+	})
+	_ = store.Set(ctx, "d", "d", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := store.Get(ctx, "d"); err != ErrSessionNotFound {
+		t.Fatalf("expected d expired, got %v", err)
+	}
+	if len(expired) != 1 || expired[0] != "d" || len(store.expired) != 0 {
+		t.Fatalf("expected the hook called for d, got %v, queued %v", expired, store.expired)
+	}
+
+	// stores are independent
+	other := NewInMemorySessionStore()
+	defer other.Close()
+	_ = other.Set(ctx, "a", "a", 0)
+	if _, err := store.Get(ctx, "a"); err != ErrSessionNotFound {
+		t.Fatalf("expected stores independent, got %v", err)
+	}
+}
+
+func TestTieredStore(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	newNode := func(options ...TieredStoreOptions) TieredStore {
+		remote := NewRedisSessionStoreWithClient(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+		local := NewInMemorySessionStore()
+		store, err := NewTieredStore(local, remote, options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = store.Close()
+			_ = local.Close()
+		})
+		for !store.Healthy() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return store
+	}
+	a, b := newNode(WithTieredLocalTTL(time.Minute)), newNode(WithTieredLocalTTL(time.Minute))
+
+	// written by neither node, so that no invalidation message may arrive after b caches it
+	mr.Set("key", "v1")
+	if v, err := b.Get(ctx, "key"); err != nil || v != "v1" {
+		t.Fatalf("expected v1, got %v %v", v, err)
+	}
+	// served by the local cache
+	mr.Set("key", "changed")
+	if v, _ := b.Get(ctx, "key"); v != "v1" {
+		t.Fatalf("expected the local copy, got %v", v)
+	}
+	// the copy of b is invalidated by the write of a
+	if err := a.Set(ctx, "key", "v2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if v, _ := b.Get(ctx, "key"); v == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the local copy invalidated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// versions are checked by the remote store
+	va, ok := a.(VersionedSessionStore)
+	if !ok {
+		t.Fatal("expected VersionedSessionStore")
+	}
+	vb := b.(VersionedSessionStore)
+	_, version, err := vb.GetVersioned(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := va.CompareAndSet(ctx, "key", "v3", version, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	mr.Set("key", "v4")
+	if _, err := vb.CompareAndSet(ctx, "key", "v5", version, time.Minute); err != ErrSessionConflict {
+		t.Fatalf("expected ErrSessionConflict, got %v", err)
+	}
+	if v, _ := b.Get(ctx, "key"); v != "v4" {
+		t.Fatalf("expected the local copy dropped on conflict, got %v", v)
+	}
+
+	// strict mode bypasses the cache once the subscription is broken
+	strict := newNode(WithTieredConsistency(ConsistencyStrict))
+	if _, err := strict.Get(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	mr.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for strict.Healthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the subscription unhealthy")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := strict.Get(ctx, "key"); err == nil {
+		t.Fatal("expected the remote store read")
+	}
+
+	local := NewInMemorySessionStore()
+	defer local.Close()
+	if _, err := NewTieredStore(local, local, WithTieredConsistency(ConsistencyStrict)); err == nil {
+		t.Fatal("expected strict mode requiring invalidation client")
+	}
+
+	// the capabilities missing in the remote store are not claimed
+	remote := NewInMemorySessionStore()
+	defer remote.Close()
+	plain, err := NewTieredStore(local, plainStore{SessionStore: remote})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	testPlainWrapper(t, plain)
+}
+
+// blockingStore blocks the first Get after reading the value until release is closed, so that the store can be
+// written while the value read is returned.
+type blockingStore struct {
+	SessionStore
+	once    sync.Once
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) Get(ctx context.Context, key string) (string, error) {
+	v, err := b.SessionStore.Get(ctx, key)
+	b.once.Do(func() {
+		close(b.reading)
+		<-b.release
+	})
+	return v, err
+}
+
+func TestTieredStoreConcurrentDelete(t *testing.T) {
+	ctx := context.Background()
+	local, memory := NewInMemorySessionStore(), NewInMemorySessionStore()
+	defer local.Close()
+	defer memory.Close()
+	remote := &blockingStore{SessionStore: memory, reading: make(chan struct{}), release: make(chan struct{})}
+	store, err := NewTieredStore(local, remote, WithTieredLocalTTL(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	_ = memory.Set(ctx, "key", "v1", time.Minute)
+
+	// the value read before the session is deleted by the same node is not cached
+	done := make(chan error)
+	go func() {
+		_, err := store.Get(ctx, "key")
+		done <- err
+	}()
+	<-remote.reading
+	if err := store.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	close(remote.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if v, err := store.Get(ctx, "key"); err != ErrSessionNotFound {
+		t.Fatalf("expected the deleted session not served, got %v, %v", v, err)
+	}
+}
+
+// plainStore hides the optional interfaces of the store, such as VersionedSessionStore and SessionIndex.
+type plainStore struct {
+	SessionStore
+}
+
+// testPlainWrapper checks that the wrapper of a plainStore is a plain store as well, which works with sessions.
+func testPlainWrapper(t *testing.T, store SessionStore) {
+	if _, ok := store.(VersionedSessionStore); ok {
+		t.Fatal("unexpected VersionedSessionStore")
+	}
+	if _, ok := store.(SessionIndex); ok {
+		t.Fatal("unexpected SessionIndex")
+	}
+	ctx := context.Background()
+	var sid string
+	getter := func() string {
+		return sid
+	}
+	setter := func(s string) {
+		sid = s
+	}
+	options := []SessionOptions{WithSessionStore(store)}
+	s, err := CreateSession(getter, setter, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Set("user", "alice")
+	if err := s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.BindUser(ctx, "alice", ClientInfo{}); err != ErrIndexNotSupported {
+		t.Fatalf("expected ErrIndexNotSupported, got %v", err)
+	}
+	s, err = CreateSession(getter, setter, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("user"); v != "alice" {
+		t.Fatalf("expected the session saved, got %v", v)
+	}
+	if err := s.RegenerateId(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Destroy(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedSessionStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ctx := context.Background()
+	oldKey, newKey := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	sid := ""
+	load := func(options ...SessionOptions) Session {
+		s, err := CreateSession(func() string {
+			return sid
+		}, func(s string) {
+			sid = s
+		}, append([]SessionOptions{WithRedisClusters([]string{mr.Addr()})}, options...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	// plaintext sessions are accepted only with the fallback
+	s := load()
+	_ = s.Set("token", "secret")
+	if err := s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	plaintext := sid
+	if s := load(WithPayloadEncryption(oldKey)); s.SessionId() == plaintext {
+		t.Fatal("expected the plaintext session rejected")
+	}
+	sid = plaintext
+	s = load(WithPayloadEncryption(oldKey), WithPayloadPlaintextFallback())
+	if v, _ := GetAs[string](s, "token"); v != "secret" {
+		t.Fatalf("expected the plaintext session loaded, got %v", v)
+	}
+	_ = s.Set("name", "alice")
+	if err := s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := mr.Get(sid)
+	if !strings.HasPrefix(payload, encryptedPayloadPrefix) || strings.Contains(payload, "secret") {
+		t.Fatalf("expected the session encrypted, got %q", payload)
+	}
+
+	// rotated keys
+	s = load(WithPayloadEncryption(newKey, oldKey))
+	if v, _ := GetAs[string](s, "token"); v != "secret" {
+		t.Fatalf("expected the session encrypted by the old key loaded, got %v", v)
+	}
+	_ = s.Set("name", "bob")
+	if err := s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rotated := sid
+	if s := load(WithPayloadEncryption(oldKey)); s.SessionId() == rotated {
+		t.Fatal("expected the session encrypted by unknown key rejected")
+	}
+
+	// payloads are bound to their sessions
+	moved := "0b7d3a52-9b7c-4b1e-8f3a-2c1d5e6f7a8b"
+	payload, _ = mr.Get(rotated)
+	_ = mr.Set(moved, payload)
+	sid = moved
+	if s := load(WithPayloadEncryption(newKey)); s.SessionId() == moved {
+		t.Fatal("expected the moved payload rejected")
+	}
+
+	// each field is encrypted in hash storage
+	sid = ""
+	s = load(WithRedisHashStorage(), WithPayloadEncryption(newKey))
+	_ = s.Set("token", "secret")
+	if err := s.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v := mr.HGet(sid, "token"); !strings.HasPrefix(v, encryptedPayloadPrefix) {
+		t.Fatalf("expected the field encrypted, got %q", v)
+	}
+	s = load(WithRedisHashStorage(), WithPayloadEncryption(newKey))
+	if v, _ := GetAs[string](s, "token"); v != "secret" {
+		t.Fatalf("expected the field decrypted, got %v", v)
+	}
+
+	memory := NewInMemorySessionStore()
+	defer memory.Close()
+	if _, err := NewEncryptedSessionStore(memory, [][]byte{[]byte("short")}); err == nil {
+		t.Fatal("expected invalid key rejected")
+	}
+
+	// the capabilities of the store are kept, while the missing ones are not claimed
+	encrypted, err := NewEncryptedSessionStore(memory, [][]byte{newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := encrypted.(VersionedSessionStore); !ok {
+		t.Fatal("expected VersionedSessionStore")
+	}
+	if _, ok := encrypted.(SessionIndex); !ok {
+		t.Fatal("expected SessionIndex")
+	}
+	plain, err := NewEncryptedSessionStore(plainStore{SessionStore: memory}, [][]byte{newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPlainWrapper(t, plain)
+	hash, err := NewEncryptedSessionStore(NewRedisHashSessionStoreWithClient(redis.NewClient(&redis.Options{Addr: mr.Addr()})),
+		[][]byte{newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hash.(FieldSessionStore); !ok {
+		t.Fatal("expected FieldSessionStore")
+	}
+	if _, ok := hash.(SessionIndex); !ok {
+		t.Fatal("expected SessionIndex")
+	}
+}
+
+func TestInMemorySessionStoreSnapshot(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemorySessionStore()
+	defer store.Close()
+	_ = store.Set(ctx, "a", "a", time.Minute)
+	_ = store.Set(ctx, "b", "\xff\x00binary", 0)
+	_ = store.Set(ctx, "c", "c", 30*time.Millisecond)
+	_ = store.IndexSession(ctx, SessionInfo{SessionId: "a", UserId: "alice", IP: "127.0.0.1"})
+	var buf bytes.Buffer
+	if err := store.Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	restored := NewInMemorySessionStore()
+	defer restored.Close()
+	var expired []string
+	restored.OnExpire(func(sessionId string) {
+		expired = append(expired, sessionId)
+	})
+	if err := restored.Restore(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0] != "c" {
+		t.Fatalf("expected the hook called for c, got %v", expired)
+	}
+	if v, err := restored.Get(ctx, "b"); err != nil || v != "\xff\x00binary" {
+		t.Fatalf("expected b restored, got %q %v", v, err)
+	}
+	if _, err := restored.Get(ctx, "c"); err != ErrSessionNotFound {
+		t.Fatalf("expected c expired, got %v", err)
+	}
+	// the remaining ttl is kept
+	restored.mutex.Lock()
+	deadline := restored.data["a"].deadline
+	restored.mutex.Unlock()
+	if d := time.Until(deadline); d > time.Minute-50*time.Millisecond || d < 50*time.Second {
+		t.Fatalf("expected the remaining ttl kept, got %v", d)
+	}
+	if infos, _ := restored.ListSessions(ctx, "alice"); len(infos) != 1 || infos[0].IP != "127.0.0.1" {
+		t.Fatalf("expected the index restored, got %v", infos)
+	}
+
+	// periodic snapshots to file
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sessions.snapshot")
+	if err := restored.RestoreFile(path); err != nil {
+		t.Fatalf("expected missing file ignored, got %v", err)
+	}
+	periodic := NewInMemorySessionStore(WithSnapshotFile(path, 10*time.Millisecond))
+	_ = periodic.Set(ctx, "d", "d", time.Minute)
+	deadline = time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the snapshot written periodically")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = periodic.Set(ctx, "e", "e", time.Minute)
+	if err := periodic.Close(); err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewInMemorySessionStore()
+	defer restarted.Close()
+	if err := restarted.RestoreFile(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"d", "e"} {
+		if _, err := restarted.Get(ctx, key); err != nil {
+			t.Fatalf("expected %v restored from file, got %v", key, err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected no temporary file left, got %v", entries)
+	}
+	if stats := periodic.Stats(); stats.SnapshotFailures != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,425 @@
+package sessionlib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Consistency decides when TieredStore serves the sessions from the local cache.
+type Consistency int
+
+const (
+	// ConsistencyEventual serves the local copies until they expire, even if the invalidation messages may be missed,
+	// e.g. redis is disconnected. Sessions may be stale for at most the local ttl on other nodes. It's the default mode.
+	ConsistencyEventual Consistency = iota
+	// ConsistencyStrict serves the local copies only if the invalidation subscription is healthy, otherwise all the
+	// reads go to the remote store.
+	ConsistencyStrict
+)
+
+// TieredStore caches the sessions of a remote store such as RedisSessionStore in a local InMemorySessionStore for a
+// short time, so that the hot sessions are not read from the remote store by each request. Writes go through to the
+// remote store, and the copies cached by other nodes are invalidated via redis pub/sub.
+//
+// TieredStore is a VersionedSessionStore only if the remote store is, and the conflicts are detected by the remote
+// store. Likewise, it's a SessionIndex only if the remote store is, to which the index is delegated. The hooks
+// registered on the remote store by OnExpire or WithOnExpire are called for the sessions expired in TieredStore as
+// well.
+type TieredStore interface {
+	SessionStore
+	// Close stops listening to the invalidation messages.
+	Close() error
+	// Healthy returns whether the invalidation subscription is healthy.
+	Healthy() bool
+}
+
+// tieredStore is the TieredStore of the remote store which is neither versioned nor indexed.
+type tieredStore struct {
+	local   *InMemorySessionStore
+	remote  SessionStore
+	options *tieredStoreOptions
+	// node identifies the store in the invalidation messages, so that it ignores its own messages
+	node    string
+	healthy atomic.Bool
+	// invalidations counts the invalidations by the writes of this node and the messages received, so that the value
+	// read from the remote store is not cached if it may have been invalidated in the meantime
+	invalidations atomic.Uint64
+	cancel        context.CancelFunc
+	done          chan struct{}
+	once          sync.Once
+}
+
+// NewTieredStore creates the store caching the sessions of remote in local. The invalidation messages are sent by the
+// client of remote if it's a RedisSessionStore, or the one specified by WithTieredInvalidation, otherwise the copies are
+// not invalidated across nodes. The store should be closed by Close, which doesn't close local and remote.
+func NewTieredStore(local *InMemorySessionStore, remote SessionStore, options ...TieredStoreOptions) (TieredStore, error) {
+	opt := &tieredStoreOptions{
+		LocalTTL:     5 * time.Second,
+		Channel:      "sessionlib:invalidate",
+		PingInterval: 5 * time.Second,
+	}
+	for _, o := range options {
+		o.apply(opt)
+	}
+	if _, ok := remote.(FieldSessionStore); ok {
+		return nil, errors.New("field session store can't be cached")
+	}
+	if _, ok := remote.(tokenStore); ok {
+		return nil, errors.New("token store can't be cached")
+	}
+	if opt.Client == nil {
+		if r, ok := remote.(*RedisSessionStore); ok {
+			opt.Client = r.client
+		}
+	}
+	if opt.Client == nil && opt.Consistency == ConsistencyStrict {
+		return nil, errors.New("strict consistency requires invalidation client")
+	}
+	node, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	t := &tieredStore{
+		local:   local,
+		remote:  remote,
+		options: opt,
+		node:    node,
+		done:    make(chan struct{}),
+	}
+	if opt.Client == nil {
+		close(t.done)
+	} else {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.cancel = cancel
+		go t.listen(ctx)
+	}
+	vs, versioned := remote.(VersionedSessionStore)
+	index, indexed := remote.(SessionIndex)
+	switch {
+	case versioned && indexed:
+		return &tieredVersionedIndexedStore{t, tieredVersioning{t, vs}, tieredIndexing{t, index}}, nil
+	case versioned:
+		return &tieredVersionedStore{t, tieredVersioning{t, vs}}, nil
+	case indexed:
+		return &tieredIndexedStore{t, tieredIndexing{t, index}}, nil
+	}
+	return t, nil
+}
+
+// tieredVersionedStore is the TieredStore of a VersionedSessionStore.
+type tieredVersionedStore struct {
+	*tieredStore
+	tieredVersioning
+}
+
+// tieredIndexedStore is the TieredStore of a SessionIndex.
+type tieredIndexedStore struct {
+	*tieredStore
+	tieredIndexing
+}
+
+// tieredVersionedIndexedStore is the TieredStore of a store which is both a VersionedSessionStore and a SessionIndex.
+type tieredVersionedIndexedStore struct {
+	*tieredStore
+	tieredVersioning
+	tieredIndexing
+}
+
+func (t *tieredStore) Close() error {
+	t.once.Do(func() {
+		if t.cancel != nil {
+			t.cancel()
+		}
+	})
+	<-t.done
+	return nil
+}
+
+func (t *tieredStore) Healthy() bool {
+	return t.healthy.Load()
+}
+
+// listen subscribes to the invalidation messages until ctx is done, tracking the health of the subscription.
+func (t *tieredStore) listen(ctx context.Context) {
+	defer close(t.done)
+	pubsub := t.options.Client.Subscribe(ctx, t.options.Channel)
+	defer pubsub.Close()
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, t.options.PingInterval)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && pubsub.Ping(ctx) == nil {
+				// idle, the pong is received next time
+				continue
+			}
+			// the subscription is recovered by the next receive, which is confirmed by a redis.Subscription
+			t.setHealthy(false)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			t.setHealthy(true)
+		case *redis.Message:
+			node, key, ok := strings.Cut(m.Payload, " ")
+			if ok && node != t.node {
+				t.invalidations.Add(1)
+				_ = t.local.Delete(ctx, key)
+			}
+		}
+	}
+}
+
+// setHealthy records the health of the subscription. The local copies are dropped once it changes since the
+// invalidation messages may have been missed.
+func (t *tieredStore) setHealthy(healthy bool) {
+	if t.healthy.Swap(healthy) != healthy {
+		t.invalidations.Add(1)
+		t.local.purge()
+	}
+}
+
+// cacheable returns whether the local copies can be used.
+func (t *tieredStore) cacheable() bool {
+	return t.options.Consistency != ConsistencyStrict || t.healthy.Load()
+}
+
+// invalidate removes the local copy and notifies other nodes to remove theirs. The failure of notifying is returned
+// only in strict mode, since the copies expire soon in eventual mode.
+func (t *tieredStore) invalidate(ctx context.Context, key string) error {
+	t.invalidations.Add(1)
+	_ = t.local.Delete(ctx, key)
+	if t.options.Client == nil {
+		return nil
+	}
+	err := t.options.Client.Publish(ctx, t.options.Channel, t.node+" "+key).Err()
+	if err != nil && t.options.Consistency == ConsistencyStrict {
+		return fmt.Errorf("fail to invalidate session: %w", err)
+	}
+	return nil
+}
+
+// the local copy carries the version: length of version | : | version | value
+func encodeLocal(value string, version string) string {
+	return strconv.Itoa(len(version)) + ":" + version + value
+}
+
+func decodeLocal(data string) (string, string, bool) {
+	n, rest, ok := strings.Cut(data, ":")
+	if !ok {
+		return "", "", false
+	}
+	length, err := strconv.Atoi(n)
+	if err != nil || length > len(rest) {
+		return "", "", false
+	}
+	return rest[length:], rest[:length], true
+}
+
+func (t *tieredStore) Get(ctx context.Context, key string) (string, error) {
+	v, _, err := t.getVersioned(ctx, key)
+	return v, err
+}
+
+// getVersioned gets the value from the local cache if possible. The version is empty if the remote store is not a
+// VersionedSessionStore.
+func (t *tieredStore) getVersioned(ctx context.Context, key string) (string, string, error) {
+	cacheable := t.cacheable()
+	if cacheable {
+		if data, err := t.local.Get(ctx, key); err == nil {
+			if v, version, ok := decodeLocal(data); ok {
+				return v, version, nil
+			}
+		}
+	}
+	invalidations := t.invalidations.Load()
+	var v, version string
+	var err error
+	if vs, ok := t.remote.(VersionedSessionStore); ok {
+		v, version, err = vs.GetVersioned(ctx, key)
+	} else {
+		v, err = t.remote.Get(ctx, key)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if cacheable && t.invalidations.Load() == invalidations {
+		_ = t.local.Set(ctx, key, encodeLocal(v, version), t.options.LocalTTL)
+	}
+	return v, version, nil
+}
+
+func (t *tieredStore) Set(ctx context.Context, key string, value string, expiration time.Duration) error {
+	if err := t.remote.Set(ctx, key, value, expiration); err != nil {
+		return err
+	}
+	return t.invalidate(ctx, key)
+}
+
+func (t *tieredStore) SetNX(ctx context.Context, key string, value string, expiration time.Duration) (bool, error) {
+	ok, err := t.remote.SetNX(ctx, key, value, expiration)
+	if err != nil || !ok {
+		return ok, err
+	}
+	return true, t.invalidate(ctx, key)
+}
+
+// Touch resets the expiration in the remote store, the local copy expires by the local ttl anyway.
+func (t *tieredStore) Touch(ctx context.Context, key string, expiration time.Duration) error {
+	return t.remote.Touch(ctx, key, expiration)
+}
+
+func (t *tieredStore) Delete(ctx context.Context, key string) error {
+	if err := t.remote.Delete(ctx, key); err != nil {
+		return err
+	}
+	return t.invalidate(ctx, key)
+}
+
+func (t *tieredStore) addExpireHook(key interface{}, hook ExpireHook) {
+	if notifier, ok := t.remote.(expiryNotifier); ok {
+		notifier.addExpireHook(key, hook)
+	}
+}
+
+func (t *tieredStore) notifyExpired(sessionId string) {
+	if notifier, ok := t.remote.(expiryNotifier); ok {
+		notifier.notifyExpired(sessionId)
+	}
+}
+
+// tieredVersioning implements VersionedSessionStore for the TieredStore of a VersionedSessionStore.
+type tieredVersioning struct {
+	t      *tieredStore
+	remote VersionedSessionStore
+}
+
+// GetVersioned gets the value from the local cache if possible.
+func (v tieredVersioning) GetVersioned(ctx context.Context, key string) (string, string, error) {
+	return v.t.getVersioned(ctx, key)
+}
+
+// CompareAndSet compares and sets by the remote store, caching the value set locally.
+func (v tieredVersioning) CompareAndSet(ctx context.Context, key string, value string, version string,
+	expiration time.Duration) (string, error) {
+	next, err := v.remote.CompareAndSet(ctx, key, value, version, expiration)
+	if err != nil {
+		if errors.Is(err, ErrSessionConflict) {
+			// the local copy is stale, the latest one is read from the remote store next time
+			v.t.invalidations.Add(1)
+			_ = v.t.local.Delete(ctx, key)
+		}
+		return "", err
+	}
+	if err := v.t.invalidate(ctx, key); err != nil {
+		return "", err
+	}
+	if v.t.cacheable() {
+		_ = v.t.local.Set(ctx, key, encodeLocal(value, next), v.t.options.LocalTTL)
+	}
+	return next, nil
+}
+
+// tieredIndexing implements SessionIndex for the TieredStore of a SessionIndex by delegating to it.
+type tieredIndexing struct {
+	t     *tieredStore
+	index SessionIndex
+}
+
+func (i tieredIndexing) IndexSession(ctx context.Context, info SessionInfo) error {
+	return i.index.IndexSession(ctx, info)
+}
+
+func (i tieredIndexing) UnindexSession(ctx context.Context, userId string, sessionId string) error {
+	return i.index.UnindexSession(ctx, userId, sessionId)
+}
+
+func (i tieredIndexing) ListSessions(ctx context.Context, userId string) ([]SessionInfo, error) {
+	return i.index.ListSessions(ctx, userId)
+}
+
+// RevokeAll revokes the sessions by the remote store and invalidates their copies.
+func (i tieredIndexing) RevokeAll(ctx context.Context, userId string) error {
+	infos, err := i.index.ListSessions(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if err := i.index.RevokeAll(ctx, userId); err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if err := i.t.invalidate(ctx, info.SessionId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type TieredStoreOptions interface {
+	apply(*tieredStoreOptions)
+}
+
+// WithTieredLocalTTL specifies how long the sessions are cached locally, 5s by default.
+func WithTieredLocalTTL(ttl time.Duration) TieredStoreOptions {
+	return newFuncTieredStoreOption(func(option *tieredStoreOptions) {
+		option.LocalTTL = ttl
+	})
+}
+
+// WithTieredInvalidation specifies the redis client sending and receiving the invalidation messages, which is the
+// client of the remote store by default if it's a RedisSessionStore.
+func WithTieredInvalidation(client redis.UniversalClient) TieredStoreOptions {
+	return newFuncTieredStoreOption(func(option *tieredStoreOptions) {
+		option.Client = client
+	})
+}
+
+// WithTieredChannel specifies the pub/sub channel of the invalidation messages, sessionlib:invalidate by default.
+func WithTieredChannel(channel string) TieredStoreOptions {
+	return newFuncTieredStoreOption(func(option *tieredStoreOptions) {
+		option.Channel = channel
+	})
+}
+
+// WithTieredConsistency specifies the consistency mode, ConsistencyEventual by default.
+func WithTieredConsistency(consistency Consistency) TieredStoreOptions {
+	return newFuncTieredStoreOption(func(option *tieredStoreOptions) {
+		option.Consistency = consistency
+	})
+}
+
+type tieredStoreOptions struct {
+	LocalTTL    time.Duration
+	Client      redis.UniversalClient
+	Channel     string
+	Consistency Consistency
+	// PingInterval is how often the idle subscription is checked
+	PingInterval time.Duration
+}
+
+type funcTieredStoreOption struct {
+	f func(option *tieredStoreOptions)
+}
+
+func (f *funcTieredStoreOption) apply(option *tieredStoreOptions) {
+	f.f(option)
+}
+
+func newFuncTieredStoreOption(f func(option *tieredStoreOptions)) TieredStoreOptions {
+	return &funcTieredStoreOption{f: f}
+}